@@ -24,7 +24,10 @@ import (
 	"github.com/nociriysname/qudata-agent/pkg/types"
 )
 
-const agentPort = 8080
+const (
+	agentPort         = 8080
+	reconcileInterval = time.Minute
+)
 
 func main() {
 	// Защита агента: если запущен как дочерний процесс для слежения
@@ -48,8 +51,13 @@ func runWatchdogChild() {
 		os.Exit(1)
 	}
 
+	// Состояния инстансов нужны, чтобы при lockdown было что удалять
+	if err := storage.LoadState(); err != nil {
+		log.Printf("Warning [Watchdog]: Failed to load state: %v", err)
+	}
+
 	// Инициализируем оркестратор для экстренного удаления
-	orch, err := orchestrator.New(qClient)
+	orch, err := orchestrator.New(qClient, cfg)
 	if err != nil {
 		log.Printf("FATAL [Watchdog]: Failed to create orchestrator: %v", err)
 		os.Exit(1)
@@ -91,7 +99,10 @@ func runMainAgent() {
 	if err := storage.LoadState(); err != nil {
 		logger.Fatalf("FATAL: State load error: %v", err)
 	}
-	logger.Printf("State loaded. Status: %s", storage.GetState().Status)
+	if err := storage.LoadOperations(); err != nil {
+		logger.Fatalf("FATAL: Operations load error: %v", err)
+	}
+	logger.Printf("State loaded. Instances: %d", len(storage.ListStates()))
 
 	// 3. Клиент API
 	qClient, err := client.NewClient(cfg.APIKey)
@@ -131,7 +142,13 @@ func runMainAgent() {
 		logger.Println("Secret key updated.")
 	}
 
-	// Если хост новый - регистрируем железо
+	// 6. Оркестратор (Kata + GPU)
+	orch, err := orchestrator.New(qClient, cfg)
+	if err != nil {
+		logger.Fatalf("FATAL: Orchestrator init failed: %v", err)
+	}
+
+	// Если хост новый - регистрируем железо. После оркестратора, чтобы в отчет попала емкость хранилища.
 	if !agentResp.HostExists {
 		logger.Println("Registering new host hardware...")
 
@@ -142,6 +159,11 @@ func runMainAgent() {
 			MaxCUDA:       hostReport.CUDAVersion,
 			Configuration: hostReport.Configuration,
 		}
+		if capacity, err := orch.StorageCapacity(context.Background()); err == nil {
+			createHostReq.Storage = capacity
+		} else {
+			logger.Printf("Warning: storage capacity is unknown: %v", err)
+		}
 
 		// Логгируем JSON для отладки
 		jsonData, _ := json.MarshalIndent(createHostReq, "", "  ")
@@ -153,16 +175,12 @@ func runMainAgent() {
 		logger.Println("Host registered successfully.")
 	}
 
-	// 6. Оркестратор (Kata + GPU)
-	orch, err := orchestrator.New(qClient)
-	if err != nil {
-		logger.Fatalf("FATAL: Orchestrator init failed: %v", err)
-	}
-
 	// Синхронизация состояния (если агент перезапустился)
 	if err := orch.SyncState(context.Background()); err != nil {
 		logger.Printf("Warning: State sync failed: %v", err)
 	}
+	go orch.WatchContainerEvents(context.Background())
+	go orch.RunReconciler(context.Background(), reconcileInterval)
 
 	// 7. Монитор безопасности (Auditd, AuthZ)
 	secMon, err := security.NewSecurityMonitor(orch, qClient)
@@ -190,7 +208,12 @@ func runMainAgent() {
 		for range ticker.C {
 			// Используем единый метод Collect(), который внутри дергает CGO для GPU
 			snapshot := statsCollector.Collect()
-			snapshot.Status = storage.GetState().Status
+			snapshot.Status = hostStatus()
+			if capacity, err := orch.StorageCapacity(context.Background()); err == nil {
+				snapshot.Storage = capacity
+			} else {
+				logger.Printf("Storage capacity error: %v", err)
+			}
 
 			if err := qClient.SendStats(snapshot); err != nil {
 				logger.Printf("Stats send error: %v", err)
@@ -218,6 +241,18 @@ func runMainAgent() {
 	logger.Println("Goodbye.")
 }
 
+// hostStatus сводит статусы инстансов в один статус хоста для статистики
+func hostStatus() string {
+	status := string(types.StatusDestroyed)
+	for _, state := range storage.ListStates() {
+		if state.Status == types.StatusRunning {
+			return string(types.StatusRunning)
+		}
+		status = string(state.Status)
+	}
+	return status
+}
+
 // getOutboundIP определяет внешний IP для регистрации
 func getOutboundIP() string {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
@@ -12,6 +12,14 @@ profile qudata-agent /usr/local/bin/qudata-agent {
   # --- Доступ к хранилищу и точкам монтирования ---
   /var/lib/qudata/storage/** rwk,
   /var/lib/qudata/mounts/** rwk,
+  /var/lib/qudata/instances/** rwk,
+  /var/lib/qudata/gpu_assignments.json* rw,
+  /var/lib/qudata/operations/** rw,
+  /var/lib/qudata/kek.sealed rw,
+  /var/lib/qudata/signing.key rw,
+  /var/lib/qudata/certificates/** rw,
+  /var/lib/qudata/snapshots/** rw,
+  /var/lib/qudata/volumes/** rw,
 
   # --- Доступ к системным файлам ---
   /etc/machine-id r,
@@ -21,6 +29,7 @@ profile qudata-agent /usr/local/bin/qudata-agent {
   /proc/meminfo r,
   # Доступ к /sys для управления драйверами GPU
   /sys/bus/pci/devices/** r,
+  /sys/bus/pci/devices/*/driver_override w,
   /sys/bus/pci/drivers/** rw,
 
   # --- Доступ к сокетам и устройствам ---
@@ -35,10 +44,25 @@ profile qudata-agent /usr/local/bin/qudata-agent {
   /usr/bin/truncate ix,
   /usr/sbin/cryptsetup ix,
   /usr/sbin/mkfs.ext4 ix,
+  /usr/sbin/mkfs.xfs ix,
+  /usr/sbin/xfs_growfs ix,
   /usr/bin/mount ix,
   /usr/bin/umount ix,
   /usr/bin/shred ix,
+  /usr/sbin/losetup ix,
+  /usr/sbin/resize2fs ix,
+  /usr/sbin/lvcreate ix,
+  /usr/sbin/lvchange ix,
+  /usr/sbin/lvextend ix,
+  /usr/sbin/lvremove ix,
+  /usr/sbin/lvs ix,
+  /usr/sbin/fsfreeze ix,
+  /usr/bin/cp ix,
   /usr/sbin/iptables ix,
+  /usr/sbin/iptables-restore ix,
+  /usr/sbin/ip6tables ix,
+  /usr/sbin/ip6tables-restore ix,
+  /usr/sbin/nft ix,
   /usr/bin/lspci ix,
   /usr/bin/tee ix,
   /usr/bin/nvidia-smi ix,
@@ -0,0 +1,187 @@
+package admission
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/distribution/reference"
+
+	config "github.com/nociriysname/qudata-agent/internal/cfg"
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// Коды отказа, которые видит бэкенд.
+const (
+	CodeInvalidReference     = "invalid_reference"
+	CodeRegistryNotAllowed   = "registry_not_allowed"
+	CodeRegistryDenied       = "registry_denied"
+	CodeRepositoryNotAllowed = "repository_not_allowed"
+	CodeRepositoryDenied     = "repository_denied"
+	CodeDigestRequired       = "digest_required"
+	CodeSignatureRequired    = "signature_required"
+	CodeSignatureInvalid     = "signature_invalid"
+	CodeDigestMismatch       = "digest_mismatch"
+	CodeSignatureUnverified  = "signature_unverified"
+)
+
+// Policy проверяет образ до скачивания (реестр, репозиторий, дайджест)
+// и после него (подпись над дайджестом манифеста).
+type Policy struct {
+	conf config.AdmissionConfig
+	keys []crypto.PublicKey
+}
+
+func NewPolicy(conf config.AdmissionConfig) (*Policy, error) {
+	p := &Policy{conf: conf}
+	for _, keySpec := range conf.SignaturePublicKeys {
+		key, err := loadPublicKey(keySpec)
+		if err != nil {
+			return nil, err
+		}
+		p.keys = append(p.keys, key)
+	}
+	if conf.RequireSignature && len(p.keys) == 0 {
+		return nil, fmt.Errorf("admission: require_signature is set but no signature_public_keys configured")
+	}
+	return p, nil
+}
+
+func loadPublicKey(spec string) (crypto.PublicKey, error) {
+	data := []byte(spec)
+	if !strings.HasPrefix(strings.TrimSpace(spec), "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(spec); err != nil {
+			return nil, fmt.Errorf("admission: failed to read public key %s: %w", spec, err)
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("admission: public key %s is not PEM encoded", spec)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("admission: failed to parse public key %s: %w", spec, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("admission: unsupported public key type %T in %s", key, spec)
+	}
+}
+
+func reject(image, code, reason string) *types.AdmissionError {
+	return &types.AdmissionError{Code: code, Reason: reason, Image: image}
+}
+
+// CheckReference проверяет ссылку на образ по спискам реестров/репозиториев и требованию дайджеста.
+func (p *Policy) CheckReference(image string, signature *types.ImageSignature) error {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return reject(image, CodeInvalidReference, err.Error())
+	}
+	registry := reference.Domain(named)
+	repository := named.Name()
+
+	if matchAny(p.conf.DeniedRegistries, registry) {
+		return reject(image, CodeRegistryDenied, fmt.Sprintf("registry %s is denied on this host", registry))
+	}
+	if len(p.conf.AllowedRegistries) > 0 && !matchAny(p.conf.AllowedRegistries, registry) {
+		return reject(image, CodeRegistryNotAllowed, fmt.Sprintf("registry %s is not in the allowlist", registry))
+	}
+	if matchAny(p.conf.DeniedRepositories, repository) {
+		return reject(image, CodeRepositoryDenied, fmt.Sprintf("repository %s is denied on this host", repository))
+	}
+	if len(p.conf.AllowedRepositories) > 0 && !matchAny(p.conf.AllowedRepositories, repository) {
+		return reject(image, CodeRepositoryNotAllowed, fmt.Sprintf("repository %s is not in the allowlist", repository))
+	}
+
+	if _, pinned := named.(reference.Canonical); p.conf.RequireDigest && !pinned {
+		return reject(image, CodeDigestRequired, "image must be pinned with @sha256: digest")
+	}
+	if p.conf.RequireSignature && signature == nil {
+		return reject(image, CodeSignatureRequired, "image_signature is required on this host")
+	}
+	return nil
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cosignPayload — поля simple signing payload, которые нужны для сверки дайджеста.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// VerifySignature сверяет подпись с дайджестом манифеста скачанного образа.
+// Без подписи и без require_signature проверка пропускается.
+func (p *Policy) VerifySignature(image, manifestDigest string, signature *types.ImageSignature) error {
+	if signature == nil {
+		if p.conf.RequireSignature {
+			return reject(image, CodeSignatureRequired, "image_signature is required on this host")
+		}
+		return nil
+	}
+	if len(p.keys) == 0 {
+		return reject(image, CodeSignatureUnverified, "no signature_public_keys configured on this host")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		return reject(image, CodeSignatureInvalid, "signature is not valid base64")
+	}
+
+	payload := []byte(manifestDigest)
+	if signature.Payload != "" {
+		if payload, err = base64.StdEncoding.DecodeString(signature.Payload); err != nil {
+			return reject(image, CodeSignatureInvalid, "payload is not valid base64")
+		}
+		var parsed cosignPayload
+		if err := json.Unmarshal(payload, &parsed); err != nil {
+			return reject(image, CodeSignatureInvalid, "payload is not a cosign simple signing document")
+		}
+		if parsed.Critical.Image.DockerManifestDigest != manifestDigest {
+			return reject(image, CodeDigestMismatch, fmt.Sprintf("signature is for %s, pulled manifest is %s",
+				parsed.Critical.Image.DockerManifestDigest, manifestDigest))
+		}
+	}
+
+	for _, key := range p.keys {
+		if verify(key, payload, sig) {
+			return nil
+		}
+	}
+	return reject(image, CodeSignatureInvalid, "signature does not match any configured public key")
+}
+
+func verify(key crypto.PublicKey, payload, sig []byte) bool {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	}
+	return false
+}
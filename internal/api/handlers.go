@@ -2,10 +2,12 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
+	"github.com/go-chi/chi/v5"
 	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
 )
 
@@ -21,6 +23,36 @@ func NewHandlers(orch Orchestrator) *Handlers {
 	return &Handlers{orchestrator: orch}
 }
 
+// writeJSON отправляет ответ в JSON. Заголовки должны быть выставлены до WriteHeader.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError подбирает HTTP-код по типу ошибки оркестратора.
+func writeError(w http.ResponseWriter, err error) {
+	var rejection *agenttypes.AdmissionError
+	if errors.As(err, &rejection) {
+		writeJSON(w, http.StatusForbidden, map[string]any{"error": rejection})
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, agenttypes.ErrInstanceNotFound), errors.Is(err, agenttypes.ErrOperationNotFound),
+		errors.Is(err, agenttypes.ErrSnapshotNotFound), errors.Is(err, agenttypes.ErrVolumeNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, agenttypes.ErrInvalidRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, agenttypes.ErrInvalidTransition):
+		status = http.StatusConflict
+	case errors.Is(err, agenttypes.ErrInsufficientStorage):
+		status = http.StatusInsufficientStorage
+	}
+	http.Error(w, err.Error(), status)
+}
+
 func (h *Handlers) HandleCreateInstance(w http.ResponseWriter, r *http.Request) {
 	var req agenttypes.CreateInstanceRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -28,43 +60,62 @@ func (h *Handlers) HandleCreateInstance(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	state, err := h.orchestrator.CreateInstance(r.Context(), req)
+	op, err := h.orchestrator.CreateInstance(r.Context(), req)
 	if err != nil {
 		log.Printf("ERROR: Failed to create instance: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
+	// Диапазоны портов раскрыты в состоянии инстанса. Порты, которые выбирает Docker, известны
+	// только после старта контейнера и появляются в GET /instances/{id}.
+	ports := map[string]string{}
+	if state, err := h.orchestrator.GetInstance(op.InstanceID); err == nil {
+		for containerPort, hostPort := range state.AllocatedPorts {
+			if hostPort != "" {
+				ports[containerPort] = hostPort
+			}
+		}
+	}
 	response := map[string]interface{}{
-		"instance_id": state.InstanceID,
-		"ports":       state.AllocatedPorts,
+		"instance_id":  op.InstanceID,
+		"operation_id": op.OperationID,
+		"ports":        ports,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusAccepted, response)
+}
+
+func (h *Handlers) HandleListInstances(w http.ResponseWriter, r *http.Request) {
+	response := map[string][]agenttypes.InstanceState{"instances": h.orchestrator.ListInstances()}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handlers) HandleGetInstance(w http.ResponseWriter, r *http.Request) {
+	state, err := h.orchestrator.GetInstance(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
 }
 
 func (h *Handlers) HandleDeleteInstance(w http.ResponseWriter, r *http.Request) {
-	go func() {
-		log.Println("Starting to delete instance...")
-		if err := h.orchestrator.DeleteInstance(r.Context()); err != nil {
-			log.Printf("ERROR: Failed to delete instance asynchronously: %v", err)
-		} else {
-			log.Println("Instance deleted successfully in background.")
-		}
-	}()
+	op, err := h.orchestrator.DeleteInstance(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
-	w.WriteHeader(http.StatusAccepted)
-	w.Write([]byte(`{"message": "Instance deletion started"}`))
-	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message":      "Instance deletion started",
+		"operation_id": op.OperationID,
+	})
 }
 
 func (h *Handlers) HandlePing(w http.ResponseWriter, r *http.Request) {
 	response := map[string]bool{"ok": true}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
 }
 
 func (h *Handlers) HandleAddSSHKey(w http.ResponseWriter, r *http.Request) {
@@ -78,8 +129,8 @@ func (h *Handlers) HandleAddSSHKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.orchestrator.AddSSHKey(r.Context(), req.PublicKey); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.orchestrator.AddSSHKey(r.Context(), chi.URLParam(r, "id"), req.PublicKey); err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -97,8 +148,8 @@ func (h *Handlers) HandleRemoveSSHKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.orchestrator.RemoveSSHKey(r.Context(), req.PublicKey); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.orchestrator.RemoveSSHKey(r.Context(), chi.URLParam(r, "id"), req.PublicKey); err != nil {
+		writeError(w, err)
 		return
 	}
 
@@ -106,16 +157,14 @@ func (h *Handlers) HandleRemoveSSHKey(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handlers) HandleListSSHKeys(w http.ResponseWriter, r *http.Request) {
-	keys, err := h.orchestrator.ListSSHKeys(r.Context())
+	keys, err := h.orchestrator.ListSSHKeys(r.Context(), chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	response := map[string][]string{"keys": keys}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
 }
 
 func (h *Handlers) HandleManageInstance(w http.ResponseWriter, r *http.Request) {
@@ -125,21 +174,141 @@ func (h *Handlers) HandleManageInstance(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := h.orchestrator.ManageInstance(r.Context(), req.Action); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	op, err := h.orchestrator.ManageInstance(r.Context(), chi.URLParam(r, "id"), req.Action)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"message": "Action '%s' initiated successfully"}`, req.Action)
-	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message":      fmt.Sprintf("Action '%s' initiated successfully", req.Action),
+		"operation_id": op.OperationID,
+	})
+}
+
+// HandleResizeVolume увеличивает зашифрованный том инстанса.
+func (h *Handlers) HandleResizeVolume(w http.ResponseWriter, r *http.Request) {
+	var req agenttypes.ResizeVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	op, err := h.orchestrator.ResizeVolume(r.Context(), chi.URLParam(r, "id"), req.StorageGB)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"message":      fmt.Sprintf("Volume resize to %dG started", req.StorageGB),
+		"operation_id": op.OperationID,
+	})
+}
+
+func (h *Handlers) HandleCreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, op, err := h.orchestrator.CreateSnapshot(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, map[string]string{
+		"snapshot_id":  snapshot.SnapshotID,
+		"operation_id": op.OperationID,
+	})
+}
+
+func (h *Handlers) HandleListSnapshots(w http.ResponseWriter, r *http.Request) {
+	response := map[string][]agenttypes.Snapshot{"snapshots": h.orchestrator.ListSnapshots()}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *Handlers) HandleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := h.orchestrator.GetSnapshot(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func (h *Handlers) HandleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	if err := h.orchestrator.DeleteSnapshot(chi.URLParam(r, "id")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) HandleCreateVolume(w http.ResponseWriter, r *http.Request) {
+	var req agenttypes.CreateVolumeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	volume, err := h.orchestrator.CreateVolume(r.Context(), req)
+	if err != nil {
+		log.Printf("ERROR: Failed to create volume: %v", err)
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, volume)
+}
+
+func (h *Handlers) HandleListVolumes(w http.ResponseWriter, r *http.Request) {
+	volumes := h.orchestrator.ListVolumes(r.URL.Query().Get("tenant_id"))
+	writeJSON(w, http.StatusOK, map[string][]agenttypes.PersistentVolume{"volumes": volumes})
+}
+
+func (h *Handlers) HandleGetVolume(w http.ResponseWriter, r *http.Request) {
+	volume, err := h.orchestrator.GetVolume(r.URL.Query().Get("tenant_id"), chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, volume)
+}
+
+func (h *Handlers) HandleDeleteVolume(w http.ResponseWriter, r *http.Request) {
+	if err := h.orchestrator.DeleteVolume(r.Context(), r.URL.Query().Get("tenant_id"), chi.URLParam(r, "id")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleAttachVolume подключает именованный том к остановленному инстансу.
+func (h *Handlers) HandleAttachVolume(w http.ResponseWriter, r *http.Request) {
+	var attachment agenttypes.VolumeAttachment
+	if err := json.NewDecoder(r.Body).Decode(&attachment); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	volume, err := h.orchestrator.AttachVolume(r.Context(), chi.URLParam(r, "id"), attachment)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, volume)
+}
+
+// HandleDetachVolume отключает именованный том от остановленного инстанса.
+func (h *Handlers) HandleDetachVolume(w http.ResponseWriter, r *http.Request) {
+	if err := h.orchestrator.DetachVolume(r.Context(), chi.URLParam(r, "id"), chi.URLParam(r, "volumeID")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // HandleGetInstanceLogs обрабатывает запрос на получение логов.
 func (h *Handlers) HandleGetInstanceLogs(w http.ResponseWriter, r *http.Request) {
-	logs, err := h.orchestrator.GetInstanceLogs(r.Context())
+	logs, err := h.orchestrator.GetInstanceLogs(r.Context(), chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
@@ -147,3 +316,52 @@ func (h *Handlers) HandleGetInstanceLogs(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(logs))
 }
+
+func (h *Handlers) HandleGetOperation(w http.ResponseWriter, r *http.Request) {
+	op, err := h.orchestrator.GetOperation(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, op)
+}
+
+// HandlePullProgress отдает прогресс скачивания образа как поток Server-Sent Events.
+// Поток закрывается, когда скачивание завершено.
+func (h *Handlers) HandlePullProgress(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	updates, cancel, err := h.orchestrator.SubscribePullProgress(chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case progress, ok := <-updates:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(progress)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
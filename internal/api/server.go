@@ -11,13 +11,28 @@ import (
 )
 
 type Orchestrator interface {
-	CreateInstance(ctx context.Context, req agenttypes.CreateInstanceRequest) (*agenttypes.InstanceState, error)
-	DeleteInstance(ctx context.Context) error
-	AddSSHKey(ctx context.Context, publicKey string) error
-	RemoveSSHKey(ctx context.Context, publicKey string) error
-	ListSSHKeys(ctx context.Context) ([]string, error)
-	ManageInstance(ctx context.Context, action agenttypes.InstanceAction) error
-	GetInstanceLogs(ctx context.Context) (string, error)
+	CreateInstance(ctx context.Context, req agenttypes.CreateInstanceRequest) (*agenttypes.Operation, error)
+	GetInstance(instanceID string) (*agenttypes.InstanceState, error)
+	ListInstances() []agenttypes.InstanceState
+	DeleteInstance(ctx context.Context, instanceID string) (*agenttypes.Operation, error)
+	AddSSHKey(ctx context.Context, instanceID, publicKey string) error
+	RemoveSSHKey(ctx context.Context, instanceID, publicKey string) error
+	ListSSHKeys(ctx context.Context, instanceID string) ([]string, error)
+	ManageInstance(ctx context.Context, instanceID string, action agenttypes.InstanceAction) (*agenttypes.Operation, error)
+	ResizeVolume(ctx context.Context, instanceID string, storageGB int) (*agenttypes.Operation, error)
+	CreateSnapshot(ctx context.Context, instanceID string) (*agenttypes.Snapshot, *agenttypes.Operation, error)
+	ListSnapshots() []agenttypes.Snapshot
+	GetSnapshot(snapshotID string) (*agenttypes.Snapshot, error)
+	DeleteSnapshot(snapshotID string) error
+	CreateVolume(ctx context.Context, req agenttypes.CreateVolumeRequest) (*agenttypes.PersistentVolume, error)
+	ListVolumes(tenantID string) []agenttypes.PersistentVolume
+	GetVolume(tenantID, volumeID string) (*agenttypes.PersistentVolume, error)
+	DeleteVolume(ctx context.Context, tenantID, volumeID string) error
+	AttachVolume(ctx context.Context, instanceID string, attachment agenttypes.VolumeAttachment) (*agenttypes.PersistentVolume, error)
+	DetachVolume(ctx context.Context, instanceID, volumeID string) error
+	GetInstanceLogs(ctx context.Context, instanceID string) (string, error)
+	GetOperation(operationID string) (*agenttypes.Operation, error)
+	SubscribePullProgress(instanceID string) (<-chan agenttypes.PullProgress, func(), error)
 }
 
 func NewServer(port int, orch Orchestrator) *http.Server {
@@ -32,17 +47,42 @@ func NewServer(port int, orch Orchestrator) *http.Server {
 
 	r.Get("/ping", handlers.HandlePing)
 
-	r.Route("/ssh", func(r chi.Router) {
-		r.Get("/", handlers.HandleListSSHKeys)
-		r.Post("/", handlers.HandleAddSSHKey)
-		r.Delete("/", handlers.HandleRemoveSSHKey)
-	})
-
 	r.Route("/instances", func(r chi.Router) {
+		r.Get("/", handlers.HandleListInstances)
 		r.Post("/", handlers.HandleCreateInstance)
-		r.Delete("/", handlers.HandleDeleteInstance)
-		r.Put("/", handlers.HandleManageInstance)
-		r.Get("/logs", handlers.HandleGetInstanceLogs)
+
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", handlers.HandleGetInstance)
+			r.Delete("/", handlers.HandleDeleteInstance)
+			r.Put("/", handlers.HandleManageInstance)
+			r.Get("/logs", handlers.HandleGetInstanceLogs)
+			r.Get("/pull", handlers.HandlePullProgress)
+			r.Put("/volume", handlers.HandleResizeVolume)
+			r.Post("/volumes", handlers.HandleAttachVolume)
+			r.Delete("/volumes/{volumeID}", handlers.HandleDetachVolume)
+			r.Post("/snapshots", handlers.HandleCreateSnapshot)
+
+			r.Route("/ssh", func(r chi.Router) {
+				r.Get("/", handlers.HandleListSSHKeys)
+				r.Post("/", handlers.HandleAddSSHKey)
+				r.Delete("/", handlers.HandleRemoveSSHKey)
+			})
+		})
+	})
+
+	r.Get("/operations/{id}", handlers.HandleGetOperation)
+
+	r.Route("/snapshots", func(r chi.Router) {
+		r.Get("/", handlers.HandleListSnapshots)
+		r.Get("/{id}", handlers.HandleGetSnapshot)
+		r.Delete("/{id}", handlers.HandleDeleteSnapshot)
+	})
+
+	r.Route("/volumes", func(r chi.Router) {
+		r.Get("/", handlers.HandleListVolumes)
+		r.Post("/", handlers.HandleCreateVolume)
+		r.Get("/{id}", handlers.HandleGetVolume)
+		r.Delete("/{id}", handlers.HandleDeleteVolume)
 	})
 
 	return &http.Server{
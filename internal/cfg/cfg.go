@@ -1,13 +1,62 @@
 package cfg
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
 )
 
+// defaultConfigFile — конфигурация хоста. Путь можно переопределить через QUDATA_CONFIG.
+const defaultConfigFile = "/etc/qudata/agent.json"
+
 type Config struct {
-	APIKey string
-	Port   int
+	APIKey    string          `json:"-"`
+	Port      int             `json:"port"`
+	Admission AdmissionConfig `json:"admission"`
+	Keys      KeyConfig       `json:"keys"`
+	Storage   StorageConfig   `json:"storage"`
+	Network   NetworkConfig   `json:"network"`
+}
+
+// NetworkConfig — изоляция контейнеров. Firewall: "auto" (по умолчанию: nftables, если nft
+// работает на хосте, иначе iptables), "nftables" или "iptables".
+type NetworkConfig struct {
+	Firewall string `json:"firewall,omitempty"`
+	// Egress — политика исходящего трафика. Без deny_cidrs запрещаются приватные, CGNAT и
+	// link-local сети IPv4 и IPv6, без blocked_ports — SMTP (25). Адреса хоста запрещены всегда.
+	Egress types.EgressPolicy `json:"egress"`
+}
+
+// StorageConfig — где создаются тома инстансов. Provider: "loop" (по умолчанию, LUKS на файле),
+// "lvm-thin" (LUKS на тонком томе VolumeGroup/ThinPool) или "directory" (без шифрования).
+type StorageConfig struct {
+	Provider    string                  `json:"provider,omitempty"`
+	VolumeGroup string                  `json:"volume_group,omitempty"`
+	ThinPool    string                  `json:"thin_pool,omitempty"`
+	Filesystem  types.FilesystemOptions `json:"filesystem"` // значения по умолчанию для новых томов
+	// SafetyMarginPercent — доля емкости, которая не отдается томам (по умолчанию 5%).
+	SafetyMarginPercent *float64 `json:"safety_margin_percent,omitempty"`
+}
+
+// KeyConfig — откуда берется ключ шифрования ключей (KEK), которым оборачиваются DEK томов.
+// Provider: "local" (секрет в файле, привязанный к machine-id) или "backend".
+type KeyConfig struct {
+	Provider string `json:"provider,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// AdmissionConfig — политика допуска образов на хост.
+// Реестры и репозитории задаются шаблонами path.Match, например "ghcr.io" или "ghcr.io/acme/*".
+type AdmissionConfig struct {
+	AllowedRegistries   []string `json:"allowed_registries,omitempty"`
+	DeniedRegistries    []string `json:"denied_registries,omitempty"`
+	AllowedRepositories []string `json:"allowed_repositories,omitempty"`
+	DeniedRepositories  []string `json:"denied_repositories,omitempty"`
+	RequireDigest       bool     `json:"require_digest,omitempty"`
+	RequireSignature    bool     `json:"require_signature,omitempty"`
+	SignaturePublicKeys []string `json:"signature_public_keys,omitempty"` // PEM или путь к PEM-файлу
 }
 
 func LoadConfig() (*Config, error) {
@@ -16,8 +65,24 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("QUDATA_API_KEY is required")
 	}
 
-	return &Config{
-		APIKey: apiKey,
-		Port:   8080,
-	}, nil
+	config := &Config{
+		Port: 8080,
+	}
+
+	path := os.Getenv("QUDATA_CONFIG")
+	if path == "" {
+		path = defaultConfigFile
+	}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+		}
+	case !os.IsNotExist(err):
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+
+	config.APIKey = apiKey
+	return config, nil
 }
@@ -135,17 +135,34 @@ func (c *QudataClient) CreateHost(req types.CreateHostRequest) error {
 }
 
 func (c *QudataClient) ReportIncident(incidentType, reason string) error {
-	incidentPayload := struct {
-		IncidentType    string `json:"incident_type"`
-		Timestamp       int64  `json:"timestamp"`
-		InstancesKilled bool   `json:"instances_killed"`
-	}{
+	return c.sendIncident(incident{
 		IncidentType:    incidentType,
+		Reason:          reason,
 		Timestamp:       time.Now().Unix(),
 		InstancesKilled: true,
-	}
+	})
+}
+
+// ReportInstanceIncident сообщает об инциденте одного инстанса, который агент устранил без lockdown.
+func (c *QudataClient) ReportInstanceIncident(instanceID, incidentType, reason string) error {
+	return c.sendIncident(incident{
+		IncidentType: incidentType,
+		InstanceID:   instanceID,
+		Reason:       reason,
+		Timestamp:    time.Now().Unix(),
+	})
+}
 
-	resp, err := c.doRequest("POST", "/incidents", incidentPayload)
+type incident struct {
+	IncidentType    string `json:"incident_type"`
+	InstanceID      string `json:"instance_id,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	Timestamp       int64  `json:"timestamp"`
+	InstancesKilled bool   `json:"instances_killed"`
+}
+
+func (c *QudataClient) sendIncident(payload incident) error {
+	resp, err := c.doRequest("POST", "/incidents", payload)
 	if err != nil {
 		return fmt.Errorf("failed to send incident report: %w", err)
 	}
@@ -174,3 +191,86 @@ func (c *QudataClient) NotifyInstanceReady(instanceID string) error {
 
 	return checkResponse(resp)
 }
+
+func (c *QudataClient) ReportPullProgress(instanceID string, progress types.PullProgress) error {
+	path := fmt.Sprintf("/instances/%s/pull-progress", instanceID)
+	resp, err := c.doRequest("POST", path, progress)
+	if err != nil {
+		return fmt.Errorf("failed to send pull progress: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
+
+func (c *QudataClient) ReportAdmissionRejection(rejection types.AdmissionError) error {
+	resp, err := c.doRequest("POST", "/admission/rejections", rejection)
+	if err != nil {
+		return fmt.Errorf("failed to send admission rejection: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
+
+func (c *QudataClient) ReportDrift(drifts []types.Drift) error {
+	resp, err := c.doRequest("POST", "/drift", drifts)
+	if err != nil {
+		return fmt.Errorf("failed to send drift report: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
+
+func (c *QudataClient) ReportLifecycleEvent(event types.LifecycleEvent) error {
+	path := fmt.Sprintf("/instances/%s/events", event.InstanceID)
+	resp, err := c.doRequest("POST", path, event)
+	if err != nil {
+		return fmt.Errorf("failed to send lifecycle event: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
+
+// FetchKEK получает ключ шифрования ключей хоста. Ключ не сохраняется на диск.
+func (c *QudataClient) FetchKEK() ([]byte, error) {
+	resp, err := c.doRequest("GET", "/keys/kek", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch KEK: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("fetch KEK failed: %w", err)
+	}
+
+	var wrapper struct {
+		Ok   bool `json:"ok"`
+		Data struct {
+			KEK []byte `json:"kek"` // base64
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&wrapper); err != nil {
+		return nil, fmt.Errorf("failed to decode KEK response: %w", err)
+	}
+	if !wrapper.Ok {
+		return nil, fmt.Errorf("server returned ok=false")
+	}
+	return wrapper.Data.KEK, nil
+}
+
+func (c *QudataClient) ReportDeletionCertificate(cert types.DeletionCertificate) error {
+	path := fmt.Sprintf("/instances/%s/deletion-certificate", cert.InstanceID)
+	if cert.VolumeID != "" {
+		path = fmt.Sprintf("/volumes/%s/deletion-certificate", cert.VolumeID)
+	}
+	resp, err := c.doRequest("POST", path, cert)
+	if err != nil {
+		return fmt.Errorf("failed to send deletion certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
@@ -0,0 +1,197 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	config "github.com/nociriysname/qudata-agent/internal/cfg"
+)
+
+// Источники KEK.
+const (
+	ProviderLocal   = "local"
+	ProviderBackend = "backend"
+)
+
+const (
+	defaultKeyFile = "/var/lib/qudata/kek.sealed"
+	machineIDFile  = "/etc/machine-id"
+	kekSize        = 32
+)
+
+// KEKFetcher получает KEK хоста с бэкенда.
+type KEKFetcher interface {
+	FetchKEK() ([]byte, error)
+}
+
+// WrappedKey — DEK тома, зашифрованный KEK в AES-256-GCM. ID инстанса входит в AAD,
+// поэтому обернутый ключ нельзя подложить другому инстансу.
+type WrappedKey struct {
+	Provider   string `json:"provider"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Keystore оборачивает и разворачивает DEK томов ключом шифрования ключей хоста.
+type Keystore struct {
+	provider string
+	keyFile  string
+	fetcher  KEKFetcher
+
+	mu  sync.Mutex
+	kek []byte
+}
+
+func New(conf config.KeyConfig, fetcher KEKFetcher) (*Keystore, error) {
+	k := &Keystore{provider: conf.Provider, keyFile: conf.KeyFile, fetcher: fetcher}
+	if k.provider == "" {
+		k.provider = ProviderLocal
+	}
+	if k.keyFile == "" {
+		k.keyFile = defaultKeyFile
+	}
+
+	switch k.provider {
+	case ProviderLocal:
+	case ProviderBackend:
+		if fetcher == nil {
+			return nil, errors.New("keystore: backend provider requires a KEK fetcher")
+		}
+	default:
+		return nil, fmt.Errorf("keystore: unknown provider %q", k.provider)
+	}
+	return k, nil
+}
+
+// Wrap шифрует DEK инстанса и возвращает сериализованный WrappedKey.
+func (k *Keystore) Wrap(instanceID string, dek []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := WrappedKey{Provider: k.provider, Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(wrapped.Nonce); err != nil {
+		return nil, fmt.Errorf("keystore: failed to generate nonce: %w", err)
+	}
+	wrapped.Ciphertext = aead.Seal(nil, wrapped.Nonce, dek, []byte(instanceID))
+	return json.Marshal(wrapped)
+}
+
+// Unwrap расшифровывает DEK, обернутый Wrap для того же инстанса.
+func (k *Keystore) Unwrap(instanceID string, data []byte) ([]byte, error) {
+	var wrapped WrappedKey
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("keystore: corrupted wrapped key: %w", err)
+	}
+	if wrapped.Provider != k.provider {
+		return nil, fmt.Errorf("keystore: key was wrapped by %q provider, agent uses %q", wrapped.Provider, k.provider)
+	}
+
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	dek, err := aead.Open(nil, wrapped.Nonce, wrapped.Ciphertext, []byte(instanceID))
+	if err != nil {
+		return nil, fmt.Errorf("keystore: failed to unwrap key of instance %s: %w", instanceID, err)
+	}
+	return dek, nil
+}
+
+func (k *Keystore) aead() (cipher.AEAD, error) {
+	kek, err := k.loadKEK()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadKEK получает KEK один раз и держит его только в памяти.
+func (k *Keystore) loadKEK() ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.kek != nil {
+		return k.kek, nil
+	}
+
+	var (
+		kek []byte
+		err error
+	)
+	switch k.provider {
+	case ProviderBackend:
+		kek, err = k.fetcher.FetchKEK()
+		if err == nil && len(kek) != kekSize {
+			err = fmt.Errorf("backend returned %d byte KEK, want %d", len(kek), kekSize)
+		}
+	default:
+		kek, err = sealedLocalKEK(k.keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("keystore: failed to load KEK: %w", err)
+	}
+
+	k.kek = kek
+	return kek, nil
+}
+
+// sealedLocalKEK выводит KEK из секрета в файле и machine-id хоста: копия файла на другой
+// машине не развернет ключи. Файл создается при первом обращении.
+func sealedLocalKEK(keyFile string) ([]byte, error) {
+	secret, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		secret = make([]byte, kekSize)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+			return nil, err
+		}
+		// O_EXCL: если файл успел создать другой процесс агента, используем его секрет.
+		f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+		if err != nil {
+			if os.IsExist(err) {
+				return sealedLocalKEK(keyFile)
+			}
+			return nil, err
+		}
+		if _, err := f.Write(secret); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Close()
+	} else if err != nil {
+		return nil, err
+	}
+	if len(secret) != kekSize {
+		return nil, fmt.Errorf("sealed key file %s is corrupted", keyFile)
+	}
+
+	machineID, err := os.ReadFile(machineIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read machine id: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.TrimSpace(string(machineID))))
+	return mac.Sum(nil), nil
+}
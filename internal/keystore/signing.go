@@ -0,0 +1,52 @@
+package keystore
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const signingKeyFileName = "signing.key"
+
+// SignCertificate подписывает сертификат удаления ed25519-ключом хоста, который лежит
+// рядом с файлом KEK и создается при первом использовании.
+func (k *Keystore) SignCertificate(cert *types.DeletionCertificate) error {
+	key, err := k.signingKey()
+	if err != nil {
+		return err
+	}
+
+	cert.PublicKey = key.Public().(ed25519.PublicKey)
+	cert.Signature = nil
+	payload, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+	cert.Signature = ed25519.Sign(key, payload)
+	return nil
+}
+
+func (k *Keystore) signingKey() (ed25519.PrivateKey, error) {
+	path := filepath.Join(filepath.Dir(k.keyFile), signingKeyFileName)
+	seed, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, seed, 0400); err != nil {
+			return nil, fmt.Errorf("keystore: failed to save signing key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("keystore: failed to read signing key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("keystore: signing key %s is corrupted", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,88 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// imageManifestDigest находит дайджест манифеста, под которым образ был скачан из своего репозитория.
+func imageManifestDigest(ctx context.Context, cli *client.Client, imageName string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageName)
+	if err != nil {
+		return "", err
+	}
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", imageName, err)
+	}
+
+	for _, repoDigest := range inspect.RepoDigests {
+		ref, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil || ref.Name() != named.Name() {
+			continue
+		}
+		if canonical, ok := ref.(reference.Canonical); ok {
+			return canonical.Digest().String(), nil
+		}
+	}
+	return "", fmt.Errorf("no manifest digest recorded for image %s", imageName)
+}
+
+// verifyPulledImage проверяет подпись скачанного образа и возвращает ссылку repo@sha256:...
+// на проверенный манифест: тег к созданию контейнера может уже указывать на другой образ.
+// Образ, отвергнутый политикой, удаляется с хоста; ошибки проверки без отказа политики образ не трогают.
+func (o *Orchestrator) verifyPulledImage(ctx context.Context, instanceID, imageName string, signature *agenttypes.ImageSignature) (string, error) {
+	digest, err := imageManifestDigest(ctx, o.dockerCli, imageName)
+	if err == nil {
+		err = o.admission.VerifySignature(imageName, digest, signature)
+	}
+	if err == nil {
+		named, _ := reference.ParseNormalizedNamed(imageName)
+		return named.Name() + "@" + digest, nil
+	}
+
+	var rejection *agenttypes.AdmissionError
+	if errors.As(err, &rejection) {
+		o.removeRejectedImage(ctx, instanceID, imageName)
+		o.reportAdmissionRejection(instanceID, err)
+	}
+	return "", err
+}
+
+// removeRejectedImage удаляет отвергнутый образ, если его не использует другой инстанс. Образ,
+// из которого уже созданы контейнеры, Docker без Force удалять откажется сам; состояния
+// закрывают инстансы, которые еще создаются.
+func (o *Orchestrator) removeRejectedImage(ctx context.Context, instanceID, imageName string) {
+	for _, state := range storage.ListStates() {
+		if state.InstanceID != instanceID && state.Image == imageName {
+			log.Printf("[Admission] Keeping rejected image %s: it is used by instance %s", imageName, state.InstanceID)
+			return
+		}
+	}
+	if _, err := o.dockerCli.ImageRemove(ctx, imageName, types.ImageRemoveOptions{PruneChildren: true}); err != nil {
+		log.Printf("Warning: failed to remove rejected image %s: %v", imageName, err)
+	}
+}
+
+// reportAdmissionRejection отправляет бэкенду структурированный отказ политики допуска.
+func (o *Orchestrator) reportAdmissionRejection(instanceID string, err error) {
+	var rejection *agenttypes.AdmissionError
+	if !errors.As(err, &rejection) {
+		return
+	}
+	rejection.InstanceID = instanceID
+	log.Printf("[Admission] %v", rejection)
+	if err := o.qudataCli.ReportAdmissionRejection(*rejection); err != nil {
+		log.Printf("Warning: failed to report admission rejection: %v", err)
+	}
+}
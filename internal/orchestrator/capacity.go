@@ -0,0 +1,131 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const defaultSafetyMarginPercent = 5.0
+
+// storageAccountant не дает разреженным томам пообещать больше места, чем есть на хосте.
+// Резерв тома — его полный размер из состояния инстанса или метаданных именованного тома;
+// pending — резервы, которые еще не попали в состояние.
+type storageAccountant struct {
+	mu            sync.Mutex
+	marginPercent float64
+	pending       int64
+}
+
+func newStorageAccountant(marginPercent *float64) (*storageAccountant, error) {
+	margin := defaultSafetyMarginPercent
+	if marginPercent != nil {
+		margin = *marginPercent
+	}
+	if margin < 0 || margin >= 100 {
+		return nil, fmt.Errorf("storage: safety_margin_percent must be in [0, 100), got %v", margin)
+	}
+	return &storageAccountant{marginPercent: margin}, nil
+}
+
+// StorageCapacity возвращает емкость хранилища, в котором создаются новые тома.
+func (o *Orchestrator) StorageCapacity(ctx context.Context) (*agenttypes.StorageCapacity, error) {
+	o.accountant.mu.Lock()
+	defer o.accountant.mu.Unlock()
+	return o.storageCapacity(ctx, o.volumes[o.volume])
+}
+
+// reserveStorage резервирует bytes под новый или растущий том, если их можно пообещать.
+// Резерв снимается возвращенной функцией после того, как новый размер сохранен в состоянии.
+func (o *Orchestrator) reserveStorage(ctx context.Context, provider VolumeProvider, bytes int64) (func(), error) {
+	a := o.accountant
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if bytes <= 0 {
+		return func() {}, nil
+	}
+	c, err := o.storageCapacity(ctx, provider)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check storage capacity: %w", err)
+	}
+	if bytes > c.AvailableBytes {
+		return nil, fmt.Errorf("%w: volume needs %s, %s is available (%s reserved by volumes, %s safety margin)",
+			agenttypes.ErrInsufficientStorage, formatBytes(bytes), formatBytes(c.AvailableBytes),
+			formatBytes(c.ReservedBytes), formatBytes(c.MarginBytes))
+	}
+
+	a.pending += bytes
+	return func() {
+		a.mu.Lock()
+		a.pending -= bytes
+		a.mu.Unlock()
+	}, nil
+}
+
+// storageCapacity считает емкость хранилища provider. Вызывается под accountant.mu.
+func (o *Orchestrator) storageCapacity(ctx context.Context, provider VolumeProvider) (*agenttypes.StorageCapacity, error) {
+	total, free, err := provider.Capacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c := &agenttypes.StorageCapacity{
+		Provider:      provider.Name(),
+		TotalBytes:    total,
+		FreeBytes:     free,
+		ReservedBytes: o.accountant.pending,
+		MarginBytes:   int64(float64(total) * o.accountant.marginPercent / 100),
+	}
+
+	for _, state := range storage.ListStates() {
+		if !holdsVolume(&state) || o.volumeFor(&state) != provider {
+			continue
+		}
+		c.ReservedBytes += int64(state.StorageGB) << 30
+		c.AllocatedBytes += provider.Allocated(ctx, &state)
+	}
+	for _, volume := range storage.ListVolumes() {
+		volumeState := namedVolumeState(&volume)
+		if o.volumeFor(volumeState) != provider {
+			continue
+		}
+		c.ReservedBytes += int64(volume.SizeGB) << 30
+		c.AllocatedBytes += provider.Allocated(ctx, volumeState)
+	}
+
+	// Записанная часть томов уже вычтена из свободного места; вычитаем только обещанное, но не записанное.
+	unwritten := max(c.ReservedBytes-c.AllocatedBytes, 0)
+	c.AvailableBytes = max(free-c.MarginBytes-unwritten, 0)
+	return c, nil
+}
+
+// holdsVolume сообщает, занимает ли инстанс место томом. Том failed-инстанса занимает место,
+// только если он сохранен (контейнер пропал), а не уничтожен при откате создания.
+func holdsVolume(state *agenttypes.InstanceState) bool {
+	switch state.Status {
+	case agenttypes.StatusDestroyed:
+		return false
+	case agenttypes.StatusFailed:
+		if state.LuksDevicePath != "" {
+			return pathExists(state.LuksDevicePath)
+		}
+		return state.MountPoint != "" && pathExists(state.MountPoint)
+	}
+	return true
+}
+
+func filesystemCapacity(path string) (int64, int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	return int64(fs.Blocks) * fs.Bsize, int64(fs.Bavail) * fs.Bsize, nil
+}
+
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+}
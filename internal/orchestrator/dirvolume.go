@@ -0,0 +1,60 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// dirVolume — обычный каталог без шифрования и без квоты. Только для неконфиденциальных SKU.
+type dirVolume struct{}
+
+func (v *dirVolume) Name() string    { return VolumeDirectory }
+func (v *dirVolume) Encrypted() bool { return false }
+
+func (v *dirVolume) Prepare(state *types.InstanceState) {
+	state.LuksDevicePath = ""
+	state.LuksMapperName = ""
+}
+
+func (v *dirVolume) Create(ctx context.Context, state *types.InstanceState, storageGB int) error {
+	if err := os.MkdirAll(state.MountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create instance directory: %w", err)
+	}
+	return nil
+}
+
+func (v *dirVolume) Open(ctx context.Context, state *types.InstanceState) error {
+	return os.MkdirAll(state.MountPoint, 0755)
+}
+
+func (v *dirVolume) IsOpen(state *types.InstanceState) bool {
+	return pathExists(state.MountPoint)
+}
+
+func (v *dirVolume) Close(ctx context.Context, state *types.InstanceState) error {
+	return nil
+}
+
+func (v *dirVolume) Capacity(ctx context.Context) (int64, int64, error) {
+	return filesystemCapacity(mountDir)
+}
+
+// Allocated всегда 0: каталог не резервирует место, его данные видны как занятое место файловой системы.
+func (v *dirVolume) Allocated(ctx context.Context, state *types.InstanceState) int64 {
+	return 0
+}
+
+func (v *dirVolume) Resize(ctx context.Context, state *types.InstanceState, storageGB int) error {
+	return fmt.Errorf("%w: %s volumes have no size limit to grow", types.ErrInvalidRequest, VolumeDirectory)
+}
+
+// Destroy удаляет каталог. Данные не шифровались, поэтому сертификат не выдается.
+func (v *dirVolume) Destroy(ctx context.Context, state *types.InstanceState) (*types.DeletionCertificate, error) {
+	if err := os.RemoveAll(state.MountPoint); err != nil {
+		return nil, fmt.Errorf("failed to remove instance directory: %w", err)
+	}
+	return nil, nil
+}
@@ -3,73 +3,68 @@ package orchestrator
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
-	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
-	"github.com/docker/go-connections/nat"
 
+	"github.com/nociriysname/qudata-agent/internal/storage"
 	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
 )
 
 const (
 	containerDataPath = "/data"
+	// instanceLabel помечает контейнеры, которыми владеет агент.
+	instanceLabel = "ai.qudata.instance-id"
 )
 
-func runContainer(
+func instanceImageName(req *agenttypes.CreateInstanceRequest) string {
+	if req.ImageTag == "" {
+		return req.Image
+	}
+	// Дайджест в image_tag закрепляет конкретный манифест
+	if strings.HasPrefix(req.ImageTag, "sha256:") {
+		return fmt.Sprintf("%s@%s", req.Image, req.ImageTag)
+	}
+	return fmt.Sprintf("%s:%s", req.Image, req.ImageTag)
+}
+
+// createContainer создает контейнер инстанса из образа imageRef — проверенного дайджеста,
+// а не тега, который мог быть перевешан после проверки.
+func createContainer(
 	ctx context.Context,
 	cli *client.Client,
 	req *agenttypes.CreateInstanceRequest,
+	imageRef string,
 	state *agenttypes.InstanceState,
 	deviceMappings []container.DeviceMapping,
 	runtimeName string,
 ) (string, error) {
 
-	imageName := fmt.Sprintf("%s:%s", req.Image, req.ImageTag)
-	if req.ImageTag == "" {
-		imageName = req.Image
-	}
-
-	reader, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
-	if err != nil {
-		return "", fmt.Errorf("failed to pull image %s: %w", imageName, err)
-	}
-	defer func() { _ = reader.Close() }()
-
-	if _, err := io.Copy(os.Stdout, reader); err != nil {
-		log.Printf("Warning: could not read ImagePull output: %v", err)
-	}
-
 	var envs []string
 	for k, v := range req.EnvVariables {
 		envs = append(envs, fmt.Sprintf("%s=%s", k, v))
 	}
 
-	portBindings := nat.PortMap{}
-	exposedPorts := nat.PortSet{}
-	for containerPort, hostPort := range req.Ports {
-		port, err := nat.NewPort("tcp", containerPort)
-		if err != nil {
-			return "", fmt.Errorf("invalid container port %s: %w", containerPort, err)
-		}
-		exposedPorts[port] = struct{}{}
-		portBindings[port] = []nat.PortBinding{
-			{
-				HostIP:   "0.0.0.0",
-				HostPort: hostPort,
-			},
-		}
+	mappings, err := parsePorts(req.Ports)
+	if err != nil {
+		return "", err
+	}
+	exposedPorts, portBindings, err := publishPorts(mappings, state.PortAccess)
+	if err != nil {
+		return "", err
 	}
 
 	containerConfig := &container.Config{
-		Image:        imageName,
+		Image:        imageRef,
 		Env:          envs,
 		ExposedPorts: exposedPorts,
 		Tty:          true,
+		Labels:       map[string]string{instanceLabel: state.InstanceID},
 	}
 
 	hostConfig := &container.HostConfig{
@@ -82,23 +77,84 @@ func runContainer(
 			},
 		},
 		PortBindings: portBindings,
+		// Перезапусками управляет агент (см. restart.go), Docker контейнер не поднимает.
+		RestartPolicy: container.RestartPolicy{Name: container.RestartPolicyDisabled},
 		Resources: container.Resources{
 			Devices: deviceMappings,
 		},
+		Annotations: map[string]string{},
 	}
+	hostConfig.Mounts = append(hostConfig.Mounts, namedVolumeMounts(state.Volumes)...)
+	applyResources(req, hostConfig)
 
 	resp, err := cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
 	if err != nil {
 		return "", fmt.Errorf("failed to create container: %w", err)
 	}
-	
-	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return "", fmt.Errorf("failed to start container %s: %w", resp.ID, err)
+
+	return resp.ID, nil
+}
+
+func namedVolumeMounts(volumes []agenttypes.VolumeAttachment) []mount.Mount {
+	mounts := make([]mount.Mount, 0, len(volumes))
+	for _, attachment := range volumes {
+		mounts = append(mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   namedVolumeMountPoint(attachment.VolumeID),
+			Target:   attachment.MountPath,
+			ReadOnly: attachment.ReadOnly,
+		})
+	}
+	return mounts
+}
+
+// recreateContainer создает копию остановленного контейнера с прежними образом, портами,
+// устройствами и ресурсами, но с именованными томами volumes, и удаляет старый контейнер.
+func recreateContainer(ctx context.Context, cli *client.Client, containerID string, volumes []agenttypes.VolumeAttachment) (string, error) {
+	inspect, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+	if inspect.State.Running {
+		return "", fmt.Errorf("%w: container %s is running", agenttypes.ErrInvalidTransition, containerID)
+	}
+
+	hostConfig := inspect.HostConfig
+	var mounts []mount.Mount
+	for _, m := range hostConfig.Mounts {
+		if !storage.IsVolumeID(filepath.Base(m.Source)) {
+			mounts = append(mounts, m)
+		}
 	}
+	hostConfig.Mounts = append(mounts, namedVolumeMounts(volumes)...)
 
+	resp, err := cli.ContainerCreate(ctx, inspect.Config, hostConfig, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+	if err := removeContainer(ctx, cli, containerID); err != nil {
+		log.Printf("Warning: failed to remove replaced container %s: %v", containerID, err)
+	}
 	return resp.ID, nil
 }
 
+// instanceContainers находит контейнеры инстанса по метке, в том числе созданные,
+// но не попавшие в состояние из-за падения агента.
+func instanceContainers(ctx context.Context, cli *client.Client, instanceID string) ([]string, error) {
+	list, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", instanceLabel, instanceID))),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list))
+	for _, c := range list {
+		ids = append(ids, c.ID)
+	}
+	return ids, nil
+}
+
 func removeContainer(ctx context.Context, cli *client.Client, containerID string) error {
 	if containerID == "" {
 		return nil
@@ -0,0 +1,168 @@
+package orchestrator
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// defaultDenyCIDRs — сети, закрытые для инстансов, если в конфиге хоста нет deny_cidrs:
+// RFC1918, CGNAT, link-local (в том числе метаданные облака 169.254.169.254), ULA и link-local IPv6.
+var defaultDenyCIDRs = []string{
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+	"100.64.0.0/10",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+var defaultBlockedPorts = []int{25}
+
+// egressPolicyVersion записывается в правила инстанса; правила с меньшей версией собираются заново.
+const egressPolicyVersion = 1
+
+// egressPolicy — политика хоста, проверенная при старте.
+type egressPolicy struct {
+	deny         []netip.Prefix
+	allow        []netip.Prefix
+	blockedPorts []int
+}
+
+// newEgressPolicy проверяет политику из конфига и добавляет к запретам адреса самого хоста.
+func newEgressPolicy(conf agenttypes.EgressPolicy) (*egressPolicy, error) {
+	denyCIDRs := conf.DenyCIDRs
+	if denyCIDRs == nil {
+		denyCIDRs = defaultDenyCIDRs
+	}
+	blockedPorts := conf.BlockedPorts
+	if blockedPorts == nil {
+		blockedPorts = defaultBlockedPorts
+	}
+
+	deny, err := parsePrefixes(denyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("network: deny_cidrs: %w", err)
+	}
+	allow, err := parsePrefixes(conf.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("network: allow_cidrs: %w", err)
+	}
+	if err := validatePorts(blockedPorts); err != nil {
+		return nil, fmt.Errorf("network: blocked_ports: %w", err)
+	}
+
+	addrs, err := hostAddresses()
+	if err != nil {
+		return nil, fmt.Errorf("network: %w", err)
+	}
+	for _, ip := range addrs {
+		if ip.IsGlobalUnicast() {
+			deny = append(deny, netip.PrefixFrom(ip, ip.BitLen()))
+		}
+	}
+
+	return &egressPolicy{deny: deny, allow: allow, blockedPorts: blockedPorts}, nil
+}
+
+// resolve накладывает политику инстанса на политику хоста. Инстанс может добавить запреты и
+// закрытые порты и сузить разрешения, но не расширить их.
+func (p *egressPolicy) resolve(req *agenttypes.EgressPolicy) (agenttypes.EgressRules, error) {
+	rules := agenttypes.EgressRules{
+		Version:      egressPolicyVersion,
+		BlockedPorts: slices.Clone(p.blockedPorts),
+		Allow:        formatPrefixes(p.allow),
+		HostDeny:     formatPrefixes(p.deny),
+	}
+	if req == nil {
+		return rules, nil
+	}
+
+	deny, err := parsePrefixes(req.DenyCIDRs)
+	if err != nil {
+		return rules, fmt.Errorf("egress.deny_cidrs: %w", err)
+	}
+	rules.InstanceDeny = formatPrefixes(deny)
+
+	if err := validatePorts(req.BlockedPorts); err != nil {
+		return rules, fmt.Errorf("egress.blocked_ports: %w", err)
+	}
+	for _, port := range req.BlockedPorts {
+		if !slices.Contains(rules.BlockedPorts, port) {
+			rules.BlockedPorts = append(rules.BlockedPorts, port)
+		}
+	}
+
+	if req.AllowCIDRs != nil {
+		allow, err := parsePrefixes(req.AllowCIDRs)
+		if err != nil {
+			return rules, fmt.Errorf("egress.allow_cidrs: %w", err)
+		}
+		for _, prefix := range allow {
+			if !slices.ContainsFunc(p.allow, func(host netip.Prefix) bool { return containsPrefix(host, prefix) }) {
+				return rules, fmt.Errorf("egress.allow_cidrs: %s is not allowed by host policy", prefix)
+			}
+		}
+		rules.Allow = formatPrefixes(allow)
+	}
+	return rules, nil
+}
+
+// compileEgress раскладывает политику инстанса в упорядоченный список правил.
+func compileEgress(rules agenttypes.EgressRules) []firewallRule {
+	var compiled []firewallRule
+	for _, port := range rules.BlockedPorts {
+		compiled = append(compiled, firewallRule{proto: "tcp", port: port}, firewallRule{proto: "udp", port: port})
+	}
+	add := func(cidrs []string, accept bool) {
+		for _, cidr := range cidrs {
+			// Правила записаны агентом после проверки, поэтому ошибок разбора здесь нет.
+			if prefix, err := netip.ParsePrefix(cidr); err == nil {
+				compiled = append(compiled, firewallRule{peer: prefix, accept: accept})
+			}
+		}
+	}
+	add(rules.InstanceDeny, false)
+	add(rules.Allow, true)
+	add(rules.HostDeny, false)
+	return compiled
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(cidr)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func formatPrefixes(prefixes []netip.Prefix) []string {
+	cidrs := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		cidrs = append(cidrs, prefix.String())
+	}
+	return cidrs
+}
+
+func validatePorts(ports []int) error {
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// containsPrefix сообщает, лежит ли inner целиком внутри outer.
+func containsPrefix(outer, inner netip.Prefix) bool {
+	return outer.Addr().Is4() == inner.Addr().Is4() && outer.Bits() <= inner.Bits() && outer.Contains(inner.Addr())
+}
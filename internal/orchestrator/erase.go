@@ -0,0 +1,178 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	"github.com/nociriysname/qudata-agent/internal/utils"
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// luksHeaderSize — размер заголовка LUKS2 по умолчанию вместе с областью keyslots.
+const luksHeaderSize = 16 << 20
+
+// eraseRecorder выполняет шаги уничтожения тома и записывает результат каждого в сертификат.
+type eraseRecorder struct {
+	cert *types.DeletionCertificate
+	errs []error
+}
+
+func (r *eraseRecorder) skip(name, reason string) {
+	r.cert.Steps = append(r.cert.Steps, types.DeletionStep{Name: name, Skipped: true, Detail: reason, At: time.Now().UTC()})
+}
+
+func (r *eraseRecorder) run(name string, fn func() error) bool {
+	step := types.DeletionStep{Name: name, At: time.Now().UTC()}
+	if err := fn(); err != nil {
+		step.Error = err.Error()
+		r.errs = append(r.errs, fmt.Errorf("%s: %w", name, err))
+	} else {
+		step.OK = true
+	}
+	r.cert.Steps = append(r.cert.Steps, step)
+	return step.OK
+}
+
+// deleteEncryptedVolume уничтожает том криптографически: стирает keyslots LUKS2, затирает заголовок
+// и только потом удаляет нижележащее устройство шагом removeStep. Каждый шаг проверяется; при любой
+// ошибке возвращается ошибка, а сертификат фиксирует, что именно не удалось. Если устройства нет,
+// сертификат равен nil.
+func deleteEncryptedVolume(ctx context.Context, state *types.InstanceState, removeStep string, remove func() error) (*types.DeletionCertificate, error) {
+	r := &eraseRecorder{cert: &types.DeletionCertificate{
+		InstanceID: state.InstanceID,
+		ImagePath:  state.LuksDevicePath,
+		StartedAt:  time.Now().UTC(),
+	}}
+
+	if isMounted(state.MountPoint) {
+		r.run("umount", func() error {
+			return utils.RunCommand(ctx, "", "umount", state.MountPoint)
+		})
+	} else {
+		r.skip("umount", "not mounted")
+	}
+
+	if pathExists(mapperDevice(state)) {
+		r.run("luks_close", func() error {
+			return utils.RunCommand(ctx, "", "cryptsetup", "luksClose", state.LuksMapperName)
+		})
+	} else {
+		r.skip("luks_close", "mapper not open")
+	}
+
+	imageExists := pathExists(state.LuksDevicePath)
+	switch {
+	case !imageExists:
+		r.skip("luks_erase", "image does not exist")
+	case len(r.errs) > 0:
+		r.skip("luks_erase", "volume is still in use")
+	default:
+		r.run("hash_header", func() error {
+			hash, err := headerHash(state.LuksDevicePath)
+			r.cert.HeaderHashBefore = hash
+			return err
+		})
+		erased := r.run("luks_erase", func() error {
+			return utils.RunCommand(ctx, "", "cryptsetup", "luksErase", "--batch-mode", state.LuksDevicePath)
+		})
+		if erased {
+			wiped := r.run("wipe_header", func() error {
+				return wipeHeader(state.LuksDevicePath)
+			})
+			if wiped {
+				r.run("verify_wipe", func() error {
+					hash, err := headerHash(state.LuksDevicePath)
+					if err != nil {
+						return err
+					}
+					r.cert.HeaderHashAfter = hash
+					if hash == r.cert.HeaderHashBefore {
+						return errors.New("header is unchanged after wipe")
+					}
+					if utils.RunCommand(ctx, "", "cryptsetup", "isLuks", state.LuksDevicePath) == nil {
+						return errors.New("image is still recognized as LUKS")
+					}
+					return nil
+				})
+			}
+		}
+		if len(r.errs) == 0 {
+			r.run(removeStep, remove)
+		}
+	}
+
+	// Без обернутого DEK том уже не расшифровать, поэтому ключ удаляется только после стирания.
+	if len(r.errs) == 0 {
+		r.run("remove_wrapped_key", func() error {
+			return storage.ClearWrappedKey(state.InstanceID)
+		})
+		_ = os.Remove(state.MountPoint)
+	}
+
+	r.cert.FinishedAt = time.Now().UTC()
+	r.cert.Erased = len(r.errs) == 0
+	if !imageExists {
+		return nil, errors.Join(r.errs...)
+	}
+	return r.cert, errors.Join(r.errs...)
+}
+
+// headerHash считает sha256 заголовка LUKS2 (первые luksHeaderSize байт образа).
+func headerHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(f, luksHeaderSize)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// wipeHeader перезаписывает заголовок случайными данными и сбрасывает их на диск.
+func wipeHeader(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := int64(luksHeaderSize)
+	// У блочных устройств Stat возвращает нулевой размер.
+	if info.Mode().IsRegular() {
+		size = min(info.Size(), size)
+	}
+	if _, err := io.CopyN(f, rand.Reader, size); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// issueDeletionCertificate подписывает сертификат ключом хоста, сохраняет его и отправляет бэкенду.
+func (o *Orchestrator) issueDeletionCertificate(cert *types.DeletionCertificate) {
+	if err := o.keys.SignCertificate(cert); err != nil {
+		log.Printf("ERROR: failed to sign deletion certificate of %s: %v", cert.Subject(), err)
+	}
+	if err := storage.SaveDeletionCertificate(cert); err != nil {
+		log.Printf("Warning: failed to save deletion certificate of %s: %v", cert.Subject(), err)
+	}
+	if err := o.qudataCli.ReportDeletionCertificate(*cert); err != nil {
+		log.Printf("Warning: failed to send deletion certificate of %s: %v", cert.Subject(), err)
+	}
+}
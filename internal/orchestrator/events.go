@@ -0,0 +1,142 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const eventsRetryInterval = 5 * time.Second
+
+// WatchContainerEvents следит за событиями контейнеров агента и обновляет статусы инстансов.
+// После обрыва подписки переподключается и дочитывает события с момента последнего полученного.
+func (o *Orchestrator) WatchContainerEvents(ctx context.Context) {
+	since := time.Now()
+	for {
+		options := types.EventsOptions{
+			Since: strconv.FormatInt(since.Unix(), 10),
+			Filters: filters.NewArgs(
+				filters.Arg("type", string(events.ContainerEventType)),
+				filters.Arg("label", instanceLabel),
+				filters.Arg("event", string(events.ActionStart)),
+				filters.Arg("event", string(events.ActionDie)),
+				filters.Arg("event", string(events.ActionOOM)),
+				filters.Arg("event", string(events.ActionKill)),
+			),
+		}
+
+		msgs, errs := o.dockerCli.Events(ctx, options)
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-msgs:
+				since = time.Unix(0, msg.TimeNano)
+				o.handleContainerEvent(ctx, msg)
+			case err := <-errs:
+				log.Printf("Warning: docker events subscription lost: %v", err)
+				break loop
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventsRetryInterval):
+		}
+	}
+}
+
+func (o *Orchestrator) handleContainerEvent(ctx context.Context, msg events.Message) {
+	instanceID := msg.Actor.Attributes[instanceLabel]
+	if instanceID == "" {
+		return
+	}
+
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, ok := storage.GetState(instanceID)
+	if !ok || state.ContainerID != msg.Actor.ID {
+		return
+	}
+
+	event := agenttypes.LifecycleEvent{
+		InstanceID:  instanceID,
+		ContainerID: msg.Actor.ID,
+		Action:      string(msg.Action),
+		At:          time.Unix(0, msg.TimeNano).UTC(),
+	}
+
+	switch msg.Action {
+	case events.ActionDie:
+		exit := agenttypes.ContainerExit{At: event.At}
+		exit.ExitCode, _ = strconv.Atoi(msg.Actor.Attributes["exitCode"])
+
+		// События приходят с опозданием: при рестарте контейнер к этому моменту уже снова работает.
+		inspect, err := o.dockerCli.ContainerInspect(ctx, msg.Actor.ID)
+		if err == nil {
+			exit.OOMKilled = inspect.State.OOMKilled
+			exit.StartedAt, _ = time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+		}
+		state.LastExit = &exit
+		event.ExitCode = &exit.ExitCode
+		event.OOMKilled = exit.OOMKilled
+
+		if state.Status == agenttypes.StatusRunning && (err != nil || !inspect.State.Running) {
+			reason := fmt.Sprintf("container exited with code %d", exit.ExitCode)
+			if exit.OOMKilled {
+				reason += " (OOM killed)"
+			}
+			state.Transition(agenttypes.StatusExited, reason)
+			o.applyRestartPolicy(&state)
+		}
+		o.saveEventState(&state)
+
+	case events.ActionOOM:
+		event.OOMKilled = true
+
+	case events.ActionKill:
+		event.Signal = msg.Actor.Attributes["signal"]
+
+	case events.ActionStart:
+		// Агент переводит инстанс в running сам, под той же блокировкой. Любой другой статус
+		// означает старт в обход агента (docker start): контейнер получил новый IP и работает без правил.
+		if state.Status != agenttypes.StatusRunning {
+			if err := o.isolateStarted(ctx, &state); err != nil {
+				log.Printf("ERROR: instance %s was started outside the agent: %v", instanceID, err)
+				state.Transition(agenttypes.StatusError, fmt.Sprintf("started outside the agent: %v", err))
+			} else {
+				o.recordPublishedPorts(ctx, &state)
+				state.Transition(agenttypes.StatusRunning, "container started")
+			}
+			o.saveEventState(&state)
+		}
+	}
+
+	event.Status = state.Status
+	log.Printf("[Events] Instance %s: container %s (status %s)", instanceID, event.Action, event.Status)
+	o.reportLifecycleEvent(event)
+}
+
+func (o *Orchestrator) reportLifecycleEvent(event agenttypes.LifecycleEvent) {
+	if err := o.qudataCli.ReportLifecycleEvent(event); err != nil {
+		log.Printf("Warning: failed to report lifecycle event of instance %s: %v", event.InstanceID, err)
+	}
+}
+
+func (o *Orchestrator) saveEventState(state *agenttypes.InstanceState) {
+	if err := storage.SaveState(state); err != nil {
+		log.Printf("ERROR: failed to persist state of instance %s: %v", state.InstanceID, err)
+	}
+}
@@ -0,0 +1,120 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nociriysname/qudata-agent/internal/utils"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const (
+	fsExt4 = "ext4"
+	fsXFS  = "xfs"
+)
+
+// allowedMountOptions — опции, которые арендатор может включить для /data.
+var allowedMountOptions = map[string]bool{
+	"nodev": true, "nosuid": true, "noexec": true, "noatime": true, "nodiratime": true,
+	"relatime": true, "lazytime": true, "discard": true,
+}
+
+// instanceFilesystem накладывает параметры запроса на значения по умолчанию хоста и проверяет результат.
+func instanceFilesystem(defaults agenttypes.FilesystemOptions, req *agenttypes.FilesystemOptions) (agenttypes.FilesystemOptions, error) {
+	fs := defaults
+	if req != nil {
+		if req.Type != "" && req.Type != fs.Type {
+			// Параметры ext4 из конфига хоста не переносятся на другую файловую систему.
+			fs = agenttypes.FilesystemOptions{Type: req.Type, MountOptions: defaults.MountOptions}
+		}
+		if req.ReservedBlocksPercent != nil {
+			fs.ReservedBlocksPercent = req.ReservedBlocksPercent
+		}
+		if req.BytesPerInode != 0 {
+			fs.BytesPerInode = req.BytesPerInode
+		}
+		if req.MountOptions != nil {
+			fs.MountOptions = req.MountOptions
+		}
+	}
+	if fs.Type == "" {
+		fs.Type = fsExt4
+	}
+
+	switch fs.Type {
+	case fsExt4:
+		if p := fs.ReservedBlocksPercent; p != nil && (*p < 0 || *p > 50) {
+			return fs, fmt.Errorf("filesystem.reserved_blocks_percent must be between 0 and 50")
+		}
+		if fs.BytesPerInode != 0 && (fs.BytesPerInode < 1024 || fs.BytesPerInode > 67108864) {
+			return fs, fmt.Errorf("filesystem.bytes_per_inode must be between 1024 and 67108864")
+		}
+	case fsXFS:
+		// XFS выделяет inode динамически и не резервирует блоки под root.
+		if fs.ReservedBlocksPercent != nil || fs.BytesPerInode != 0 {
+			return fs, fmt.Errorf("reserved_blocks_percent and bytes_per_inode are not supported for xfs")
+		}
+	default:
+		return fs, fmt.Errorf("unsupported filesystem.type %q", fs.Type)
+	}
+
+	for _, opt := range fs.MountOptions {
+		if !allowedMountOptions[opt] {
+			return fs, fmt.Errorf("mount option %q is not allowed", opt)
+		}
+	}
+	return fs, nil
+}
+
+// makeFilesystem создает файловую систему тома на устройстве.
+func makeFilesystem(ctx context.Context, device string, fs agenttypes.FilesystemOptions) error {
+	switch fs.Type {
+	case fsXFS:
+		if err := utils.RunCommand(ctx, "", "mkfs.xfs", "-f", device); err != nil {
+			return fmt.Errorf("mkfs.xfs failed: %w", err)
+		}
+	default:
+		args := []string{"-F"}
+		if fs.ReservedBlocksPercent != nil {
+			args = append(args, "-m", strconv.FormatFloat(*fs.ReservedBlocksPercent, 'f', -1, 64))
+		}
+		if fs.BytesPerInode != 0 {
+			args = append(args, "-i", strconv.Itoa(fs.BytesPerInode))
+		}
+		if err := utils.RunCommand(ctx, "", "mkfs.ext4", append(args, device)...); err != nil {
+			return fmt.Errorf("mkfs.ext4 failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// mountFilesystem монтирует том с опциями инстанса; используется и при создании, и при восстановлении.
+func mountFilesystem(ctx context.Context, device, mountPoint string, fs agenttypes.FilesystemOptions) error {
+	args := []string{}
+	if fs.Type != "" {
+		args = append(args, "-t", fs.Type)
+	}
+	if len(fs.MountOptions) > 0 {
+		args = append(args, "-o", strings.Join(fs.MountOptions, ","))
+	}
+	if err := utils.RunCommand(ctx, "", "mount", append(args, device, mountPoint)...); err != nil {
+		return fmt.Errorf("mount failed: %w", err)
+	}
+	return nil
+}
+
+// growFilesystem растягивает смонтированную файловую систему на все устройство.
+func growFilesystem(ctx context.Context, device, mountPoint string, fs agenttypes.FilesystemOptions) error {
+	if fs.Type == fsXFS {
+		if err := utils.RunCommand(ctx, "", "xfs_growfs", mountPoint); err != nil {
+			return fmt.Errorf("xfs_growfs failed: %w", err)
+		}
+		return nil
+	}
+	if err := utils.RunCommand(ctx, "", "resize2fs", device); err != nil {
+		return fmt.Errorf("resize2fs failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/nociriysname/qudata-agent/internal/cfg"
+	"github.com/nociriysname/qudata-agent/internal/utils"
+)
+
+// Имена бэкендов firewall в конфигурации хоста.
+const (
+	FirewallAuto     = "auto"
+	FirewallNftables = "nftables"
+	FirewallIptables = "iptables"
+)
+
+// Firewall применяет к контейнерам инстансов правила исходящего и входящего трафика.
+type Firewall interface {
+	Name() string
+	// Apply заменяет правила инстанса правилами rules для адресов addrs, включая правила прежнего IP.
+	Apply(ctx context.Context, instanceID string, addrs containerAddrs, rules []firewallRule) error
+	// Remove удаляет все правила инстанса. Отсутствие правил ошибкой не считается.
+	Remove(ctx context.Context, instanceID string) error
+	// Missing возвращает правила из rules, которые для addrs сейчас не действуют.
+	Missing(ctx context.Context, instanceID string, addrs containerAddrs, rules []firewallRule) []firewallRule
+}
+
+// newFirewall выбирает бэкенд при старте агента: nftables, если nft работает на хосте, иначе iptables.
+func newFirewall(ctx context.Context, conf cfg.NetworkConfig) (Firewall, error) {
+	name := conf.Firewall
+	if name == "" || name == FirewallAuto {
+		name = FirewallIptables
+		if err := utils.RunCommand(ctx, "", "nft", "list", "tables"); err == nil {
+			name = FirewallNftables
+		}
+	}
+
+	switch name {
+	case FirewallNftables:
+		log.Printf("Network isolation: using nftables (table inet %s)", nftTable)
+		return &nftablesFirewall{}, nil
+	case FirewallIptables:
+		log.Printf("Network isolation: using iptables (chain %s)", iptablesChain)
+		return &iptablesFirewall{}, nil
+	}
+	return nil, fmt.Errorf("network: unknown firewall %q", conf.Firewall)
+}
+
+// firewallRule — одно правило цепочки инстанса. Правила проверяются по порядку до первого совпадения.
+type firewallRule struct {
+	inbound bool         // входящий трафик к опубликованному порту контейнера
+	peer    netip.Prefix // адрес на другой стороне: назначение исходящего или источник входящего; невалидный — любой
+	proto   string       // tcp или udp; пусто — любой протокол
+	port    int          // порт назначения
+	portEnd int          // конец диапазона портов; 0 — один порт
+	accept  bool         // выйти из цепочки, не проверяя остальные запреты
+}
+
+// v6 сообщает, относится ли правило только к IPv6. Правила без адреса действуют в обоих семействах.
+func (r firewallRule) v6() bool {
+	return r.peer.IsValid() && r.peer.Addr().Is6()
+}
+
+// family сообщает, действует ли правило в семействе адресов v6.
+func (r firewallRule) family(v6 bool) bool {
+	return !r.peer.IsValid() || r.v6() == v6
+}
+
+// peerString печатает адрес так же, как его печатают nft и iptables.
+func (r firewallRule) peerString() string {
+	if r.peer.IsSingleIP() {
+		return r.peer.Addr().String()
+	}
+	return r.peer.String()
+}
+
+// portRange печатает порт или диапазон портов с разделителем sep: "-" для nft, ":" для iptables.
+func (r firewallRule) portRange(sep string) string {
+	if r.portEnd > r.port {
+		return fmt.Sprintf("%d%s%d", r.port, sep, r.portEnd)
+	}
+	return fmt.Sprint(r.port)
+}
+
+func (r firewallRule) String() string {
+	verdict := "deny"
+	if r.accept {
+		verdict = "allow"
+	}
+	var parts []string
+	if r.inbound {
+		verdict += " inbound"
+	}
+	parts = append(parts, verdict)
+	if r.proto != "" {
+		parts = append(parts, r.proto+"/"+r.portRange("-"))
+	}
+	if r.peer.IsValid() {
+		if r.inbound {
+			parts = append(parts, "from")
+		}
+		parts = append(parts, r.peerString())
+	}
+	return strings.Join(parts, " ")
+}
@@ -6,78 +6,269 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/docker/docker/api/types/container"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
 	"github.com/nociriysname/qudata-agent/internal/utils"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
 )
 
-// PrepareGPU находит первую NVIDIA карту, отвязывает от драйвера nvidia и привязывает к vfio-pci
-func PrepareGPU(ctx context.Context) (string, string, string, error) {
-	// 1. Ищем адрес GPU (0300/0302 класс)
-	out, err := utils.RunCommandGetOutput(ctx, "", "sh", "-c", "lspci -D -nn | grep -i nvidia | grep -E '0300|0302' | head -n 1")
-	if err != nil || len(out) == 0 {
-		return "", "", "", fmt.Errorf("no NVIDIA GPU found")
-	}
-	// Пример: 0000:01:00.0 3D controller...
-	pciAddr := strings.Fields(out)[0]
-
-	// 2. Получаем ID устройства (Vendor:Device) для драйвера vfio
-	idOut, _ := utils.RunCommandGetOutput(ctx, "", "lspci", "-n", "-s", pciAddr)
-	// Пример: 0000:01:00.0 0300: 10de:2230 ... -> берем 10de:2230
-	parts := strings.Fields(idOut)
-	vendorDev := ""
-	for _, p := range parts {
-		if strings.Contains(p, ":") && len(p) == 9 {
-			vendorDev = strings.Replace(p, ":", " ", 1) // 10de 2230
-			break
+const (
+	pciDevicesDir  = "/sys/bus/pci/devices"
+	vfioDriverDir  = "/sys/bus/pci/drivers/vfio-pci"
+	nvidiaVendorID = "0x10de"
+)
+
+// GPUAllocator раздает свободные NVIDIA GPU инстансам и помнит, какая карта кому отдана.
+type GPUAllocator struct {
+	mu          sync.Mutex
+	assignments map[string]storage.GPUAssignment // PCI адрес -> назначение
+}
+
+// NewGPUAllocator восстанавливает назначения из состояний инстансов и журнала назначений.
+// Журнал он не переписывает: этим занимается ReclaimOrphans в основном процессе агента.
+func NewGPUAllocator() *GPUAllocator {
+	a := &GPUAllocator{}
+	a.Reload()
+	return a
+}
+
+// Reload перечитывает назначения с диска. Нужен процессу, который живет дольше своего
+// снимка состояния (watchdog перед lockdown).
+func (a *GPUAllocator) Reload() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.assignments = make(map[string]storage.GPUAssignment)
+	for _, state := range storage.ListStates() {
+		for _, dev := range state.GPUDevices {
+			a.assignments[dev.PciAddress] = storage.GPUAssignment{InstanceID: state.InstanceID, OriginalDriver: dev.OriginalDriver}
+			for _, fn := range dev.Functions {
+				a.assignments[fn.PciAddress] = storage.GPUAssignment{InstanceID: state.InstanceID, OriginalDriver: fn.OriginalDriver}
+			}
+		}
+	}
+	// Карта могла быть назначена недосозданному инстансу, которого еще нет в его состоянии.
+	for addr, assignment := range storage.LoadGPUAssignments() {
+		if _, ok := a.assignments[addr]; !ok {
+			a.assignments[addr] = assignment
 		}
 	}
+}
 
-	// 3. Проверяем текущий драйвер
-	driverPath := fmt.Sprintf("/sys/bus/pci/devices/%s/driver", pciAddr)
-	link, err := os.Readlink(driverPath)
-	originalDriver := "nvidia" // предположение по умолчанию
+// ReclaimOrphans возвращает хосту карты, числящиеся за несуществующими инстансами.
+func (a *GPUAllocator) ReclaimOrphans(ctx context.Context) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	if err == nil {
-		originalDriver = filepath.Base(link)
-		if originalDriver != "vfio-pci" {
-			log.Printf("[GPU] Unbinding %s from %s...", pciAddr, originalDriver)
-			// Отвязываем от текущего драйвера
-			unbindPath := filepath.Join(driverPath, "unbind")
-			if err := os.WriteFile(unbindPath, []byte(pciAddr), 0200); err != nil {
-				return "", "", "", fmt.Errorf("failed to unbind: %w", err)
-			}
-			time.Sleep(500 * time.Millisecond)
+	for addr, assignment := range a.assignments {
+		if _, ok := storage.GetState(assignment.InstanceID); ok {
+			continue
+		}
+		log.Printf("[GPU] %s is assigned to unknown instance %s, returning it to host", addr, assignment.InstanceID)
+		ReturnGPUToHost(ctx, addr, assignment.OriginalDriver)
+		delete(a.assignments, addr)
+	}
+	a.persist()
+}
+
+// Allocate привязывает count свободных GPU вместе со всеми функциями их групп IOMMU к vfio-pci
+// и возвращает их вместе с маппингами устройств vfio.
+func (a *GPUAllocator) Allocate(ctx context.Context, instanceID string, count int) ([]agenttypes.GPUDevice, []container.DeviceMapping, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	all, err := listNvidiaGPUs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var free []string
+	for _, addr := range all {
+		if _, taken := a.assignments[addr]; !taken {
+			free = append(free, addr)
+		}
+	}
+	if len(free) < count {
+		return nil, nil, fmt.Errorf("requested %d GPUs, but only %d of %d are free", count, len(free), len(all))
+	}
+
+	var devices []agenttypes.GPUDevice
+	for _, addr := range free[:count] {
+		dev, err := a.bindGroup(ctx, instanceID, addr, all)
+		if err != nil {
+			a.releaseLocked(ctx, instanceID)
+			return nil, nil, fmt.Errorf("failed to prepare GPU %s: %w", addr, err)
+		}
+		devices = append(devices, dev)
+	}
+
+	return devices, vfioDeviceMappings(devices), nil
+}
+
+// bindGroup привязывает к vfio-pci карту и все остальные функции ее группы IOMMU.
+func (a *GPUAllocator) bindGroup(ctx context.Context, instanceID, gpuAddr string, gpus []string) (agenttypes.GPUDevice, error) {
+	functions, err := iommuGroupFunctions(gpuAddr)
+	if err != nil {
+		return agenttypes.GPUDevice{}, err
+	}
+
+	var dev agenttypes.GPUDevice
+	for _, addr := range functions {
+		if addr != gpuAddr && slices.Contains(gpus, addr) {
+			return dev, fmt.Errorf("GPU shares IOMMU group with GPU %s", addr)
+		}
+
+		// Назначение фиксируется до перепривязки, чтобы после падения агента функцию можно было вернуть.
+		originalDriver := currentDriver(addr)
+		if originalDriver == "vfio-pci" {
+			originalDriver = ""
+		}
+		if originalDriver == "" && addr == gpuAddr {
+			originalDriver = "nvidia"
+		}
+		a.assignments[addr] = storage.GPUAssignment{InstanceID: instanceID, OriginalDriver: originalDriver}
+		a.persist()
+
+		bound, err := bindToVFIO(ctx, addr, originalDriver)
+		if err != nil {
+			return dev, err
+		}
+		if addr == gpuAddr {
+			bound.Functions = dev.Functions
+			dev = bound
 		} else {
-			log.Printf("[GPU] %s is already bound to vfio-pci", pciAddr)
+			dev.Functions = append(dev.Functions, agenttypes.PCIFunction{PciAddress: addr, OriginalDriver: originalDriver})
+		}
+	}
+	return dev, nil
+}
+
+// iommuGroupFunctions перечисляет функции группы IOMMU устройства, кроме мостов PCI:
+// мосты остаются у своих драйверов и VFIO их не требует.
+func iommuGroupFunctions(pciAddr string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(pciDevicesDir, pciAddr, "iommu_group", "devices"))
+	if err != nil {
+		return nil, fmt.Errorf("IOMMU group not found (Check BIOS VT-d/AMD-Vi settings!): %v", err)
+	}
+	var functions []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(readSysfs(entry.Name(), "class"), "0x0604") {
+			functions = append(functions, entry.Name())
 		}
 	}
+	return functions, nil
+}
 
-	// 4. Привязываем к VFIO
-	// Загружаем модуль ядра
-	utils.RunCommand(ctx, "", "modprobe", "vfio-pci")
+// Release возвращает хосту все карты, числящиеся за инстансом, и освобождает их в пуле.
+func (a *GPUAllocator) Release(ctx context.Context, instanceID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.releaseLocked(ctx, instanceID)
+}
+
+func (a *GPUAllocator) releaseLocked(ctx context.Context, instanceID string) {
+	for addr, assignment := range a.assignments {
+		if assignment.InstanceID != instanceID {
+			continue
+		}
+		ReturnGPUToHost(ctx, addr, assignment.OriginalDriver)
+		delete(a.assignments, addr)
+	}
+	a.persist()
+}
 
-	// Сообщаем драйверу новый ID (игнорируем ошибку, если уже есть)
-	os.WriteFile("/sys/bus/pci/drivers/vfio-pci/new_id", []byte(vendorDev), 0200)
+func (a *GPUAllocator) persist() {
+	if err := storage.SaveGPUAssignments(a.assignments); err != nil {
+		log.Printf("Warning: failed to persist GPU assignments: %v", err)
+	}
+}
 
-	// Привязываем устройство (игнорируем ошибку, если уже привязано)
-	bindPath := "/sys/bus/pci/drivers/vfio-pci/bind"
-	if _, err := os.Stat(driverPath); os.IsNotExist(err) {
-		if err := os.WriteFile(bindPath, []byte(pciAddr), 0200); err != nil {
-			return "", "", "", fmt.Errorf("failed to bind to vfio-pci: %w", err)
+// listNvidiaGPUs перечисляет все NVIDIA функции в sysfs и оставляет видеоконтроллеры (класс 0300/0302).
+func listNvidiaGPUs() ([]string, error) {
+	entries, err := os.ReadDir(pciDevicesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PCI devices: %w", err)
+	}
+
+	var gpus []string
+	for _, entry := range entries {
+		addr := entry.Name()
+		if readSysfs(addr, "vendor") != nvidiaVendorID {
+			continue
+		}
+		class := readSysfs(addr, "class")
+		if strings.HasPrefix(class, "0x0300") || strings.HasPrefix(class, "0x0302") {
+			gpus = append(gpus, addr)
 		}
 	}
+	if len(gpus) == 0 {
+		return nil, fmt.Errorf("no NVIDIA GPU found")
+	}
 
-	// 5. Ищем группу IOMMU (На реальном ПК она ОБЯЗАНА быть)
-	iommuLink := fmt.Sprintf("/sys/bus/pci/devices/%s/iommu_group", pciAddr)
-	groupLink, err := os.Readlink(iommuLink)
+	sort.Strings(gpus)
+	return gpus, nil
+}
+
+func readSysfs(pciAddr, attr string) string {
+	data, err := os.ReadFile(filepath.Join(pciDevicesDir, pciAddr, attr))
 	if err != nil {
-		return "", "", "", fmt.Errorf("IOMMU group not found (Check BIOS VT-d/AMD-Vi settings!): %v", err)
+		return ""
 	}
+	return strings.TrimSpace(string(data))
+}
 
-	groupID := filepath.Base(groupLink)
-	vfioPath := fmt.Sprintf("/dev/vfio/%s", groupID)
+// currentDriver возвращает имя драйвера, к которому сейчас привязано устройство ("" если ни к какому).
+func currentDriver(pciAddr string) string {
+	link, err := os.Readlink(filepath.Join(pciDevicesDir, pciAddr, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(link)
+}
+
+// bindToVFIO отвязывает функцию от драйвера хоста и привязывает к vfio-pci через driver_override,
+// чтобы не захватить остальные карты той же модели.
+func bindToVFIO(ctx context.Context, pciAddr, originalDriver string) (agenttypes.GPUDevice, error) {
+	dev := agenttypes.GPUDevice{PciAddress: pciAddr, OriginalDriver: originalDriver}
+	devDir := filepath.Join(pciDevicesDir, pciAddr)
+
+	driver := currentDriver(pciAddr)
+	if driver == "vfio-pci" {
+		log.Printf("[GPU] %s is already bound to vfio-pci", pciAddr)
+	} else {
+		if driver != "" {
+			log.Printf("[GPU] Unbinding %s from %s...", pciAddr, driver)
+			if err := os.WriteFile(filepath.Join(devDir, "driver", "unbind"), []byte(pciAddr), 0200); err != nil {
+				return dev, fmt.Errorf("failed to unbind: %w", err)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+
+		// Загружаем модуль ядра
+		utils.RunCommand(ctx, "", "modprobe", "vfio-pci")
+
+		if err := os.WriteFile(filepath.Join(devDir, "driver_override"), []byte("vfio-pci"), 0200); err != nil {
+			return dev, fmt.Errorf("failed to set driver_override: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(vfioDriverDir, "bind"), []byte(pciAddr), 0200); err != nil && currentDriver(pciAddr) != "vfio-pci" {
+			return dev, fmt.Errorf("failed to bind to vfio-pci: %w", err)
+		}
+	}
+
+	// Ищем группу IOMMU (На реальном ПК она ОБЯЗАНА быть)
+	groupLink, err := os.Readlink(filepath.Join(devDir, "iommu_group"))
+	if err != nil {
+		return dev, fmt.Errorf("IOMMU group not found (Check BIOS VT-d/AMD-Vi settings!): %v", err)
+	}
+	dev.IOMMUGroup = filepath.Base(groupLink)
+	vfioPath := vfioGroupPath(dev.IOMMUGroup)
 
 	// Ждем появления файла (udev может тупить пару миллисекунд)
 	for i := 0; i < 10; i++ {
@@ -88,19 +279,51 @@ func PrepareGPU(ctx context.Context) (string, string, string, error) {
 	}
 
 	if _, err := os.Stat(vfioPath); os.IsNotExist(err) {
-		return "", "", "", fmt.Errorf("device file %s did not appear. Is IOMMU enabled?", vfioPath)
+		return dev, fmt.Errorf("device file %s did not appear. Is IOMMU enabled?", vfioPath)
 	}
 
-	log.Printf("[GPU] Ready for passthrough: %s (Group %s)", pciAddr, groupID)
-	return pciAddr, originalDriver, vfioPath, nil
+	log.Printf("[GPU] Ready for passthrough: %s (Group %s)", pciAddr, dev.IOMMUGroup)
+	return dev, nil
 }
 
-// ReturnGPUToHost возвращает карту обратно
+func vfioGroupPath(group string) string {
+	return fmt.Sprintf("/dev/vfio/%s", group)
+}
+
+// vfioDeviceMappings пробрасывает в контейнер /dev/vfio/vfio и по одному файлу на каждую группу IOMMU.
+func vfioDeviceMappings(devices []agenttypes.GPUDevice) []container.DeviceMapping {
+	mappings := []container.DeviceMapping{
+		{PathOnHost: "/dev/vfio/vfio", PathInContainer: "/dev/vfio/vfio", CgroupPermissions: "rwm"},
+	}
+	seen := make(map[string]bool)
+	for _, dev := range devices {
+		if seen[dev.IOMMUGroup] {
+			continue
+		}
+		seen[dev.IOMMUGroup] = true
+		path := vfioGroupPath(dev.IOMMUGroup)
+		mappings = append(mappings, container.DeviceMapping{PathOnHost: path, PathInContainer: path, CgroupPermissions: "rwm"})
+	}
+	return mappings
+}
+
+// ReturnGPUToHost возвращает функцию GPU драйверу хоста. Без известного драйвера ядро
+// подбирает его само через drivers_probe.
 func ReturnGPUToHost(ctx context.Context, pciAddr, originalDriver string) error {
 	log.Printf("[GPU] Returning %s to %s...", pciAddr, originalDriver)
 
+	// Снимаем override, иначе карта снова попадет в vfio-pci
+	os.WriteFile(filepath.Join(pciDevicesDir, pciAddr, "driver_override"), []byte("\n"), 0200)
+
 	// Unbind from vfio-pci
-	os.WriteFile("/sys/bus/pci/drivers/vfio-pci/unbind", []byte(pciAddr), 0200)
+	os.WriteFile(filepath.Join(vfioDriverDir, "unbind"), []byte(pciAddr), 0200)
+
+	if originalDriver == "" {
+		if err := os.WriteFile("/sys/bus/pci/drivers_probe", []byte(pciAddr), 0200); err != nil {
+			log.Printf("Warning: failed to probe driver for %s: %v", pciAddr, err)
+		}
+		return nil
+	}
 
 	// Bind to original
 	bindPath := fmt.Sprintf("/sys/bus/pci/drivers/%s/bind", originalDriver)
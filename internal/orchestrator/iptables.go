@@ -0,0 +1,191 @@
+package orchestrator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/nociriysname/qudata-agent/internal/utils"
+)
+
+const iptablesChain = "DOCKER-USER"
+
+// iptablesFamily — утилиты одного семейства адресов.
+type iptablesFamily struct {
+	cmd     string
+	restore string
+	v6      bool
+}
+
+var (
+	iptablesV4 = iptablesFamily{cmd: "iptables", restore: "iptables-restore"}
+	iptablesV6 = iptablesFamily{cmd: "ip6tables", restore: "ip6tables-restore", v6: true}
+)
+
+// iptablesFirewall — запасной бэкенд для хостов без nftables. Правила инстанса лежат в его
+// собственной цепочке, которая загружается целиком через iptables-restore. В DOCKER-USER
+// добавляется только переход в нее, помеченный комментарием с ID инстанса.
+type iptablesFirewall struct{}
+
+func (f *iptablesFirewall) Name() string { return FirewallIptables }
+
+func (f *iptablesFirewall) comment(instanceID string) string {
+	return "qudata:" + instanceID
+}
+
+// chain возвращает имя цепочки инстанса; iptables ограничивает имя 28 символами.
+func (f *iptablesFirewall) chain(instanceID string) string {
+	sum := sha256.Sum256([]byte(instanceID))
+	return "QD-" + hex.EncodeToString(sum[:])[:25]
+}
+
+func (f *iptablesFirewall) jump(op, instanceID string) []string {
+	return []string{op, iptablesChain, "-m", "comment", "--comment", f.comment(instanceID), "-j", f.chain(instanceID)}
+}
+
+// ruleSpec возвращает правило цепочки инстанса без команды и имени цепочки
+// или nil, если правило относится к другому семейству.
+func (f *iptablesFirewall) ruleSpec(family iptablesFamily, containerIP string, rule firewallRule) []string {
+	if !rule.family(family.v6) {
+		return nil
+	}
+	// Для исходящего трафика контейнер — источник пакета, для входящего — назначение.
+	self, peer := "-s", "-d"
+	if rule.inbound {
+		self, peer = peer, self
+	}
+	target := "REJECT"
+	if rule.accept {
+		target = "RETURN"
+	}
+
+	spec := []string{self, containerIP}
+	if rule.proto != "" {
+		spec = append(spec, "-p", rule.proto, "--dport", rule.portRange(":"))
+	}
+	if rule.peer.IsValid() {
+		spec = append(spec, peer, rule.peer.String())
+	}
+	return append(spec, "-j", target)
+}
+
+// Apply загружает цепочку инстанса одной транзакцией; правила прежнего IP заменяются вместе с ней.
+func (f *iptablesFirewall) Apply(ctx context.Context, instanceID string, addrs containerAddrs, rules []firewallRule) error {
+	if addrs.IPv4 == "" {
+		return fmt.Errorf("cannot apply network isolation for empty IP")
+	}
+	if err := f.apply(ctx, iptablesV4, instanceID, addrs.IPv4, rules); err != nil {
+		return err
+	}
+	if addrs.IPv6 != "" {
+		return f.apply(ctx, iptablesV6, instanceID, addrs.IPv6, rules)
+	}
+	return f.remove(ctx, iptablesV6, instanceID)
+}
+
+func (f *iptablesFirewall) apply(ctx context.Context, family iptablesFamily, instanceID, containerIP string, rules []firewallRule) error {
+	chain := f.chain(instanceID)
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "*filter\n:%s - [0:0]\n-F %s\n", chain, chain)
+	for _, rule := range rules {
+		if spec := f.ruleSpec(family, containerIP, rule); spec != nil {
+			fmt.Fprintf(&script, "-A %s %s\n", chain, strings.Join(spec, " "))
+		}
+	}
+	script.WriteString("COMMIT\n")
+	if err := utils.RunCommand(ctx, script.String(), family.restore, "--noflush"); err != nil {
+		return fmt.Errorf("failed to load %s chain %s: %w", family.cmd, chain, err)
+	}
+
+	if err := utils.RunCommand(ctx, "", family.cmd, f.jump("-C", instanceID)...); err != nil {
+		if err := utils.RunCommand(ctx, "", family.cmd, f.jump("-I", instanceID)...); err != nil {
+			return fmt.Errorf("failed to add %s jump to %s: %w", family.cmd, chain, err)
+		}
+	}
+	// Снимаются правила и переходы по IP контейнера, оставшиеся от прежних версий агента.
+	return f.removeJumps(ctx, family, instanceID, func(rule string) bool {
+		return !strings.HasSuffix(rule, "-j "+chain) || strings.Contains(rule, " -s ")
+	})
+}
+
+func (f *iptablesFirewall) Remove(ctx context.Context, instanceID string) error {
+	return errors.Join(f.remove(ctx, iptablesV4, instanceID), f.remove(ctx, iptablesV6, instanceID))
+}
+
+func (f *iptablesFirewall) remove(ctx context.Context, family iptablesFamily, instanceID string) error {
+	if err := f.removeJumps(ctx, family, instanceID, func(string) bool { return true }); err != nil {
+		return err
+	}
+	chain := f.chain(instanceID)
+	if err := utils.RunCommand(ctx, "", family.cmd, "-n", "-L", chain); err != nil {
+		return nil
+	}
+	if err := utils.RunCommand(ctx, "", family.cmd, "-F", chain); err != nil {
+		return fmt.Errorf("failed to flush %s chain %s: %w", family.cmd, chain, err)
+	}
+	if err := utils.RunCommand(ctx, "", family.cmd, "-X", chain); err != nil {
+		return fmt.Errorf("failed to delete %s chain %s: %w", family.cmd, chain, err)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) Missing(ctx context.Context, instanceID string, addrs containerAddrs, rules []firewallRule) []firewallRule {
+	missing := f.missing(ctx, iptablesV4, instanceID, addrs.IPv4, rules)
+	if addrs.IPv6 != "" {
+		for _, rule := range f.missing(ctx, iptablesV6, instanceID, addrs.IPv6, rules) {
+			if !slices.Contains(missing, rule) {
+				missing = append(missing, rule)
+			}
+		}
+	}
+	return missing
+}
+
+func (f *iptablesFirewall) missing(ctx context.Context, family iptablesFamily, instanceID, containerIP string, rules []firewallRule) []firewallRule {
+	// Без перехода из DOCKER-USER не действует ни одно правило цепочки.
+	if err := utils.RunCommand(ctx, "", family.cmd, f.jump("-C", instanceID)...); err != nil {
+		return rules
+	}
+	chain := f.chain(instanceID)
+	var missing []firewallRule
+	for _, rule := range rules {
+		spec := f.ruleSpec(family, containerIP, rule)
+		if spec == nil {
+			continue
+		}
+		if err := utils.RunCommand(ctx, "", family.cmd, append([]string{"-C", chain}, spec...)...); err != nil {
+			missing = append(missing, rule)
+		}
+	}
+	return missing
+}
+
+// removeJumps удаляет переходы инстанса из DOCKER-USER, для которых match возвращает true.
+func (f *iptablesFirewall) removeJumps(ctx context.Context, family iptablesFamily, instanceID string, match func(rule string) bool) error {
+	out, err := utils.RunCommandGetOutput(ctx, "", family.cmd, "-S", iptablesChain)
+	if err != nil {
+		if family.v6 {
+			// Без ipv6 в Docker цепочки DOCKER-USER для ip6tables нет, как нет и переходов в ней.
+			return nil
+		}
+		return fmt.Errorf("failed to list %s: %w", iptablesChain, err)
+	}
+
+	marker := fmt.Sprintf("--comment %s ", f.comment(instanceID))
+	var errs []error
+	for _, rule := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(rule, "-A ") || !strings.Contains(rule, marker) || !match(rule) {
+			continue
+		}
+		args := append([]string{"-D"}, strings.Fields(strings.TrimPrefix(rule, "-A "))...)
+		if err := utils.RunCommand(ctx, "", family.cmd, args...); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s rule %q: %w", family.cmd, rule, err))
+		}
+	}
+	return errors.Join(errs...)
+}
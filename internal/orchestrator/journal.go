@@ -0,0 +1,103 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// Шаги создания инстанса в порядке выполнения.
+const (
+	stepAllocateGPU     = "allocate_gpu"
+	stepCreateVolume    = "create_volume"
+	stepPullImage       = "pull_image"
+	stepCreateContainer = "create_container"
+	stepStartContainer  = "start_container"
+)
+
+// createJournal записывает начало и конец каждого шага до перехода к следующему.
+type createJournal struct {
+	journal storage.Journal
+	state   *agenttypes.InstanceState
+}
+
+func newCreateJournal(operationID string, state *agenttypes.InstanceState) *createJournal {
+	return &createJournal{
+		journal: storage.Journal{InstanceID: state.InstanceID, OperationID: operationID},
+		state:   state,
+	}
+}
+
+func (j *createJournal) record(step, phase string) error {
+	entry := storage.JournalEntry{Step: step, Phase: phase, At: time.Now().UTC(), State: *j.state}
+	if err := storage.AppendJournal(&j.journal, entry); err != nil {
+		return fmt.Errorf("failed to write create journal (%s %s): %w", step, phase, err)
+	}
+	return nil
+}
+
+// step выполняет fn между записями started и done.
+func (j *createJournal) step(step string, fn func() error) error {
+	if err := j.record(step, storage.JournalStarted); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return j.record(step, storage.JournalDone)
+}
+
+// recoverInterruptedCreate доводит до конца или откатывает создание, прерванное падением агента.
+// Если контейнер уже был создан, все ресурсы на месте и инстанс достаточно запустить;
+// иначе все, что успело появиться, удаляется.
+func (o *Orchestrator) recoverInterruptedCreate(ctx context.Context, state agenttypes.InstanceState) {
+	journal, err := storage.LoadJournal(state.InstanceID)
+	if err != nil {
+		log.Printf("Recovery: failed to read journal of instance %s: %v", state.InstanceID, err)
+	}
+	if journal != nil {
+		if last, ok := journal.LastState(); ok {
+			state = last
+		}
+	}
+
+	if journal != nil && journal.Done(stepCreateContainer) && state.ContainerID != "" {
+		log.Printf("Recovery: finishing creation of instance %s", state.InstanceID)
+		err := o.startContainer(ctx, &state)
+		if err == nil {
+			state.Transition(agenttypes.StatusRunning, "recovered after agent restart")
+			if err = storage.SaveState(&state); err == nil {
+				_ = storage.ClearJournal(state.InstanceID)
+				finishRecoveredOperation(journal.OperationID, nil)
+				if state.SSHEnabled {
+					go setupSSHInContainer(o.dockerCli, o.qudataCli, state.InstanceID, state.ContainerID)
+				}
+				return
+			}
+		}
+		log.Printf("Recovery: failed to finish instance %s, rolling back: %v", state.InstanceID, err)
+	}
+
+	log.Printf("Recovery: rolling back half-created instance %s", state.InstanceID)
+	cause := fmt.Errorf("interrupted by agent restart; instance rolled back")
+	o.failCreate(ctx, &state, cause)
+	if journal != nil {
+		finishRecoveredOperation(journal.OperationID, cause)
+	}
+}
+
+// finishRecoveredOperation обновляет запись операции, прерванной рестартом агента.
+func finishRecoveredOperation(operationID string, err error) {
+	op, ok := storage.GetOperation(operationID)
+	if !ok {
+		return
+	}
+	t := &operationTracker{op: op}
+	t.op.Error = ""
+	t.op.Message = "recovered after agent restart"
+	t.finish(err)
+}
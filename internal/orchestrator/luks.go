@@ -4,63 +4,265 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/nociriysname/qudata-agent/internal/keystore"
+	"github.com/nociriysname/qudata-agent/internal/storage"
 	"github.com/nociriysname/qudata-agent/internal/utils"
 	"github.com/nociriysname/qudata-agent/pkg/types"
 )
 
-func createEncryptedVolume(ctx context.Context, state *types.InstanceState, storageGB int) error {
+// loopVolume — LUKS2 поверх файла-образа в storageDir, подключенного через loop-устройство.
+type loopVolume struct {
+	keys *keystore.Keystore
+}
+
+func (v *loopVolume) Name() string    { return VolumeLoop }
+func (v *loopVolume) Encrypted() bool { return true }
+
+func (v *loopVolume) Prepare(state *types.InstanceState) {
+	state.LuksDevicePath = filepath.Join(storageDir, fmt.Sprintf("%s.img", state.InstanceID))
+	state.LuksMapperName = fmt.Sprintf("qudata-%s", state.InstanceID)
+}
+
+func (v *loopVolume) Create(ctx context.Context, state *types.InstanceState, storageGB int) error {
+	storageBytes := fmt.Sprintf("%dG", storageGB)
+	if err := utils.RunCommand(ctx, "", "truncate", "-s", storageBytes, state.LuksDevicePath); err != nil {
+		return fmt.Errorf("failed to create image file: %w", err)
+	}
+	return formatEncryptedVolume(ctx, v.keys, state)
+}
+
+func (v *loopVolume) Open(ctx context.Context, state *types.InstanceState) error {
+	return openEncryptedVolume(ctx, v.keys, state)
+}
+
+func (v *loopVolume) IsOpen(state *types.InstanceState) bool {
+	return pathExists(mapperDevice(state))
+}
+
+func (v *loopVolume) Close(ctx context.Context, state *types.InstanceState) error {
+	return closeEncryptedVolume(ctx, state)
+}
+
+// Capacity возвращает размер и свободное место файловой системы, на которой лежат образы.
+func (v *loopVolume) Capacity(ctx context.Context) (int64, int64, error) {
+	return filesystemCapacity(storageDir)
+}
+
+// Allocated возвращает место, которое разреженный образ уже занимает на диске.
+func (v *loopVolume) Allocated(ctx context.Context, state *types.InstanceState) int64 {
+	info, err := os.Stat(state.LuksDevicePath)
+	if err != nil {
+		return 0
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
+
+// Resize увеличивает том без размонтирования: файл образа, loop-устройство,
+// LUKS mapper и ext4 растут по очереди.
+func (v *loopVolume) Resize(ctx context.Context, state *types.InstanceState, storageGB int) error {
+	info, err := os.Stat(state.LuksDevicePath)
+	if err != nil {
+		return fmt.Errorf("failed to stat volume image: %w", err)
+	}
+	newSize := int64(storageGB) << 30
+	if newSize <= info.Size() {
+		return fmt.Errorf("%w: new size %dG must be larger than current %dG", types.ErrInvalidRequest, storageGB, info.Size()>>30)
+	}
+
+	loopDevice, err := backingLoopDevice(ctx, state.LuksDevicePath)
+	if err != nil {
+		return err
+	}
+
+	if err := utils.RunCommand(ctx, "", "truncate", "-s", fmt.Sprintf("%dG", storageGB), state.LuksDevicePath); err != nil {
+		return fmt.Errorf("failed to extend image file: %w", err)
+	}
+	if err := utils.RunCommand(ctx, "", "losetup", "--set-capacity", loopDevice); err != nil {
+		return fmt.Errorf("failed to refresh loop device: %w", err)
+	}
+	return growEncryptedVolume(ctx, state)
+}
+
+func (v *loopVolume) Destroy(ctx context.Context, state *types.InstanceState) (*types.DeletionCertificate, error) {
+	return deleteEncryptedVolume(ctx, state, "remove_image", func() error {
+		return os.Remove(state.LuksDevicePath)
+	})
+}
+
+// formatEncryptedVolume создает LUKS2 на state.LuksDevicePath новым DEK, открывает,
+// создает файловую систему инстанса и монтирует.
+func formatEncryptedVolume(ctx context.Context, keys *keystore.Keystore, state *types.InstanceState) error {
 	dekBytes := make([]byte, 32)
 	if _, err := rand.Read(dekBytes); err != nil {
 		return fmt.Errorf("failed to generate DEK: %w", err)
 	}
 	dek := hex.EncodeToString(dekBytes)
 
-	storageBytes := fmt.Sprintf("%dG", storageGB)
-	if err := utils.RunCommand(ctx, "", "truncate", "-s", storageBytes, state.LuksDevicePath); err != nil {
-		return fmt.Errorf("failed to create image file: %w", err)
+	// Обернутый DEK сохраняется до форматирования, чтобы том можно было открыть после любого падения.
+	wrapped, err := keys.Wrap(state.InstanceID, dekBytes)
+	if err != nil {
+		return fmt.Errorf("failed to wrap DEK: %w", err)
+	}
+	if err := storage.SaveWrappedKey(state.InstanceID, wrapped); err != nil {
+		return fmt.Errorf("failed to save wrapped DEK: %w", err)
 	}
 
-	if err := utils.RunCommand(ctx, dek, "cryptsetup", "luksFormat", "--type", "luks2", state.LuksDevicePath); err != nil {
+	if err := utils.RunCommand(ctx, dek, "cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", state.LuksDevicePath); err != nil {
 		return fmt.Errorf("luksFormat failed: %w", err)
 	}
 
-	if err := utils.RunCommand(ctx, dek, "cryptsetup", "luksOpen", state.LuksDevicePath, state.LuksMapperName); err != nil {
+	// Ключ тома держим в таблице dm, а не в keyring ядра: иначе cryptsetup resize потребует пароль.
+	if err := utils.RunCommand(ctx, dek, "cryptsetup", "luksOpen", "--disable-keyring", state.LuksDevicePath, state.LuksMapperName); err != nil {
 		return fmt.Errorf("luksOpen failed: %w", err)
 	}
 
-	mapperPath := fmt.Sprintf("/dev/mapper/%s", state.LuksMapperName)
+	mapperPath := mapperDevice(state)
 
-	if err := utils.RunCommand(ctx, "", "mkfs.ext4", mapperPath); err != nil {
-		return fmt.Errorf("mkfs.ext4 failed: %w", err)
+	if err := makeFilesystem(ctx, mapperPath, state.Filesystem); err != nil {
+		return err
 	}
 
 	if err := os.MkdirAll(state.MountPoint, 0755); err != nil {
 		return fmt.Errorf("failed to create mount point: %w", err)
 	}
 
-	if err := utils.RunCommand(ctx, "", "mount", mapperPath, state.MountPoint); err != nil {
-		return fmt.Errorf("mount failed: %w", err)
+	return mountFilesystem(ctx, mapperPath, state.MountPoint, state.Filesystem)
+}
+
+// openEncryptedVolume открывает том ключом из keystore и монтирует его. Уже открытый
+// mapper и уже смонтированный том не трогает.
+func openEncryptedVolume(ctx context.Context, keys *keystore.Keystore, state *types.InstanceState) error {
+	mapperPath := mapperDevice(state)
+	if _, err := os.Stat(mapperPath); err != nil {
+		wrapped, err := storage.LoadWrappedKey(state.InstanceID)
+		if err != nil {
+			return fmt.Errorf("no wrapped DEK for instance %s: %w", state.InstanceID, err)
+		}
+		dekBytes, err := keys.Unwrap(state.InstanceID, wrapped)
+		if err != nil {
+			return err
+		}
+		dek := hex.EncodeToString(dekBytes)
+		if err := utils.RunCommand(ctx, dek, "cryptsetup", "luksOpen", "--disable-keyring", state.LuksDevicePath, state.LuksMapperName); err != nil {
+			return fmt.Errorf("luksOpen failed: %w", err)
+		}
 	}
 
+	if isMounted(state.MountPoint) {
+		return nil
+	}
+	if err := os.MkdirAll(state.MountPoint, 0755); err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	return mountFilesystem(ctx, mapperPath, state.MountPoint, state.Filesystem)
+}
+
+// closeEncryptedVolume размонтирует том и закрывает mapper; на устройстве остается только шифротекст.
+func closeEncryptedVolume(ctx context.Context, state *types.InstanceState) error {
+	if isMounted(state.MountPoint) {
+		if err := utils.RunCommand(ctx, "", "umount", state.MountPoint); err != nil {
+			return fmt.Errorf("failed to unmount %s: %w", state.MountPoint, err)
+		}
+	}
+	if pathExists(mapperDevice(state)) {
+		if err := utils.RunCommand(ctx, "", "cryptsetup", "luksClose", state.LuksMapperName); err != nil {
+			return fmt.Errorf("luksClose failed: %w", err)
+		}
+	}
 	return nil
 }
 
-func deleteEncryptedVolume(ctx context.Context, state *types.InstanceState) error {
-	// mapperPath := fmt.Sprintf("/dev/mapper/%s", state.LuksMapperName)
+// growEncryptedVolume растягивает LUKS mapper и файловую систему на уже увеличенное устройство.
+func growEncryptedVolume(ctx context.Context, state *types.InstanceState) error {
+	if err := utils.RunCommand(ctx, "", "cryptsetup", "resize", state.LuksMapperName); err != nil {
+		return fmt.Errorf("cryptsetup resize failed: %w", err)
+	}
+	return growFilesystem(ctx, mapperDevice(state), state.MountPoint, state.Filesystem)
+}
 
-	if err := utils.RunCommand(ctx, "", "umount", "-l", state.MountPoint); err != nil {
+func mapperDevice(state *types.InstanceState) string {
+	return fmt.Sprintf("/dev/mapper/%s", state.LuksMapperName)
+}
+
+// backingLoopDevice находит loop-устройство, которое cryptsetup создал для файла образа.
+func backingLoopDevice(ctx context.Context, imagePath string) (string, error) {
+	out, err := utils.RunCommandGetOutput(ctx, "", "losetup", "-j", imagePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to find loop device: %w", err)
+	}
+	device, _, found := strings.Cut(out, ":")
+	if !found || !strings.HasPrefix(device, "/dev/loop") {
+		return "", fmt.Errorf("no loop device is attached to %s", imagePath)
+	}
+	return device, nil
+}
+
+// Snapshot замораживает файловую систему и копирует образ (reflink, если ФС хоста умеет).
+func (v *loopVolume) Snapshot(ctx context.Context, state *types.InstanceState, snapshot *types.Snapshot) error {
+	dest := storage.SnapshotImagePath(snapshot.SnapshotID)
+
+	// Заморозка сбрасывает данные на устройство и останавливает запись на время копирования.
+	if err := utils.RunCommand(ctx, "", "fsfreeze", "--freeze", state.MountPoint); err != nil {
+		return fmt.Errorf("failed to freeze filesystem: %w", err)
+	}
+	copyErr := utils.RunCommand(ctx, "", "cp", "--reflink=auto", "--sparse=always", state.LuksDevicePath, dest)
+	if err := utils.RunCommand(context.Background(), "", "fsfreeze", "--unfreeze", state.MountPoint); err != nil {
+		log.Printf("ERROR: failed to unfreeze %s: %v", state.MountPoint, err)
+		return errors.Join(copyErr, fmt.Errorf("failed to unfreeze filesystem: %w", err))
+	}
+	if copyErr != nil {
+		return fmt.Errorf("failed to copy volume image: %w", copyErr)
 	}
 
-	if err := utils.RunCommand(ctx, "", "cryptsetup", "luksClose", state.LuksMapperName); err != nil {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return err
 	}
+	snapshot.SizeBytes = info.Size()
+	return nil
+}
 
-	if err := utils.RunCommand(ctx, "", "shred", "-n", "1", "-z", "-u", state.LuksDevicePath); err != nil {
+// Restore копирует образ снапшота, переоборачивает его DEK под новый инстанс и открывает том.
+func (v *loopVolume) Restore(ctx context.Context, state *types.InstanceState, snapshot types.Snapshot, storageGB int) error {
+	src := storage.SnapshotImagePath(snapshot.SnapshotID)
+	if err := utils.RunCommand(ctx, "", "cp", "--reflink=auto", "--sparse=always", src, state.LuksDevicePath); err != nil {
+		return fmt.Errorf("failed to copy snapshot image: %w", err)
+	}
+	grow := int64(storageGB)<<30 > snapshot.SizeBytes
+	if grow {
+		if err := utils.RunCommand(ctx, "", "truncate", "-s", fmt.Sprintf("%dG", storageGB), state.LuksDevicePath); err != nil {
+			return fmt.Errorf("failed to extend image file: %w", err)
+		}
 	}
 
-	_ = os.Remove(state.MountPoint)
+	wrapped, err := storage.LoadSnapshotKey(snapshot.SnapshotID)
+	if err != nil {
+		return fmt.Errorf("no wrapped DEK for snapshot %s: %w", snapshot.SnapshotID, err)
+	}
+	rewrapped, err := rewrapKey(v.keys, snapshot.SnapshotID, wrapped, state.InstanceID)
+	if err != nil {
+		return err
+	}
+	if err := storage.SaveWrappedKey(state.InstanceID, rewrapped); err != nil {
+		return fmt.Errorf("failed to save wrapped DEK: %w", err)
+	}
 
+	if err := openEncryptedVolume(ctx, v.keys, state); err != nil {
+		return err
+	}
+	if grow {
+		return growEncryptedVolume(ctx, state)
+	}
 	return nil
 }
@@ -0,0 +1,155 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nociriysname/qudata-agent/internal/keystore"
+	"github.com/nociriysname/qudata-agent/internal/utils"
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// lvmThinVolume — LUKS2 поверх тонкого логического тома в пуле volumeGroup/thinPool.
+type lvmThinVolume struct {
+	keys        *keystore.Keystore
+	volumeGroup string
+	thinPool    string
+}
+
+func (v *lvmThinVolume) Name() string    { return VolumeLVMThin }
+func (v *lvmThinVolume) Encrypted() bool { return true }
+
+func (v *lvmThinVolume) lvName(state *types.InstanceState) string {
+	return fmt.Sprintf("qudata-%s", state.InstanceID)
+}
+
+func (v *lvmThinVolume) Prepare(state *types.InstanceState) {
+	state.LuksDevicePath = fmt.Sprintf("/dev/%s/%s", v.volumeGroup, v.lvName(state))
+	state.LuksMapperName = fmt.Sprintf("qudata-%s", state.InstanceID)
+}
+
+func (v *lvmThinVolume) Create(ctx context.Context, state *types.InstanceState, storageGB int) error {
+	if err := v.checkPoolSpace(ctx, int64(storageGB)<<30); err != nil {
+		return err
+	}
+	pool := fmt.Sprintf("%s/%s", v.volumeGroup, v.thinPool)
+	err := utils.RunCommand(ctx, "", "lvcreate", "--yes", "--thin", "--virtualsize", fmt.Sprintf("%dG", storageGB),
+		"--name", v.lvName(state), pool)
+	if err != nil {
+		return fmt.Errorf("failed to create thin volume: %w", err)
+	}
+	return formatEncryptedVolume(ctx, v.keys, state)
+}
+
+func (v *lvmThinVolume) Open(ctx context.Context, state *types.InstanceState) error {
+	// После перезагрузки тонкие тома могут быть неактивны.
+	if !pathExists(state.LuksDevicePath) {
+		lv := fmt.Sprintf("%s/%s", v.volumeGroup, v.lvName(state))
+		if err := utils.RunCommand(ctx, "", "lvchange", "--activate", "y", lv); err != nil {
+			return fmt.Errorf("failed to activate %s: %w", lv, err)
+		}
+	}
+	return openEncryptedVolume(ctx, v.keys, state)
+}
+
+func (v *lvmThinVolume) IsOpen(state *types.InstanceState) bool {
+	return pathExists(mapperDevice(state))
+}
+
+func (v *lvmThinVolume) Close(ctx context.Context, state *types.InstanceState) error {
+	return closeEncryptedVolume(ctx, state)
+}
+
+func (v *lvmThinVolume) Resize(ctx context.Context, state *types.InstanceState, storageGB int) error {
+	lv := fmt.Sprintf("%s/%s", v.volumeGroup, v.lvName(state))
+	size, err := v.lvSize(ctx, lv)
+	if err != nil {
+		return err
+	}
+	newSize := int64(storageGB) << 30
+	if newSize <= size {
+		return fmt.Errorf("%w: new size %dG must be larger than current %dG", types.ErrInvalidRequest, storageGB, size>>30)
+	}
+	if err := v.checkPoolSpace(ctx, newSize-size); err != nil {
+		return err
+	}
+
+	if err := utils.RunCommand(ctx, "", "lvextend", "--size", fmt.Sprintf("%dG", storageGB), lv); err != nil {
+		return fmt.Errorf("lvextend failed: %w", err)
+	}
+	return growEncryptedVolume(ctx, state)
+}
+
+func (v *lvmThinVolume) Destroy(ctx context.Context, state *types.InstanceState) (*types.DeletionCertificate, error) {
+	lv := fmt.Sprintf("%s/%s", v.volumeGroup, v.lvName(state))
+	return deleteEncryptedVolume(ctx, state, "remove_lv", func() error {
+		return utils.RunCommand(ctx, "", "lvremove", "--yes", lv)
+	})
+}
+
+// Capacity возвращает размер тонкого пула и еще не занятое в нем место.
+func (v *lvmThinVolume) Capacity(ctx context.Context) (int64, int64, error) {
+	size, usedPercent, err := v.lvUsage(ctx, fmt.Sprintf("%s/%s", v.volumeGroup, v.thinPool))
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, int64(float64(size) * (100 - usedPercent) / 100), nil
+}
+
+// Allocated возвращает, сколько блоков пула тонкий том уже занял.
+func (v *lvmThinVolume) Allocated(ctx context.Context, state *types.InstanceState) int64 {
+	size, usedPercent, err := v.lvUsage(ctx, fmt.Sprintf("%s/%s", v.volumeGroup, v.lvName(state)))
+	if err != nil {
+		return 0
+	}
+	return int64(float64(size) * usedPercent / 100)
+}
+
+// checkPoolSpace проверяет, что в пуле физически есть место под needBytes.
+func (v *lvmThinVolume) checkPoolSpace(ctx context.Context, needBytes int64) error {
+	_, free, err := v.Capacity(ctx)
+	if err != nil {
+		return err
+	}
+	if needBytes > free {
+		pool := fmt.Sprintf("%s/%s", v.volumeGroup, v.thinPool)
+		return fmt.Errorf("%w: not enough free space in thin pool %s: need %d bytes, have %d", types.ErrInsufficientStorage, pool, needBytes, free)
+	}
+	return nil
+}
+
+// lvUsage возвращает размер тонкого тома или пула и процент занятых данными блоков.
+func (v *lvmThinVolume) lvUsage(ctx context.Context, lv string) (int64, float64, error) {
+	out, err := utils.RunCommandGetOutput(ctx, "", "lvs", "--noheadings", "--nosuffix", "--units", "b",
+		"--options", "lv_size,data_percent", lv)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to query %s: %w", lv, err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected lvs output for %s: %q", lv, out)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected size of %s %q: %w", lv, fields[0], err)
+	}
+	usedPercent, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected usage of %s %q: %w", lv, fields[1], err)
+	}
+	return size, usedPercent, nil
+}
+
+func (v *lvmThinVolume) lvSize(ctx context.Context, lv string) (int64, error) {
+	out, err := utils.RunCommandGetOutput(ctx, "", "lvs", "--noheadings", "--nosuffix", "--units", "b", "--options", "lv_size", lv)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query %s: %w", lv, err)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected size of %s: %q", lv, out)
+	}
+	return size, nil
+}
@@ -0,0 +1,400 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// Именованные тома создаются тем же поставщиком, что и тома инстансов. Ключ тома обернут
+// под его ID и хранится в его каталоге, поэтому удаление инстанса его не затрагивает.
+// Пока том не подключен к инстансу, он закрыт и на диске лежит только шифротекст.
+
+func namedVolumeMountPoint(volumeID string) string {
+	return filepath.Join(mountDir, volumeID)
+}
+
+// namedVolumeState представляет именованный том в виде, с которым работают поставщики томов.
+func namedVolumeState(volume *agenttypes.PersistentVolume) *agenttypes.InstanceState {
+	return &agenttypes.InstanceState{
+		InstanceID:     volume.VolumeID,
+		LuksDevicePath: volume.DevicePath,
+		LuksMapperName: volume.MapperName,
+		MountPoint:     volume.MountPoint,
+		StorageGB:      volume.SizeGB,
+		VolumeProvider: volume.VolumeProvider,
+		Filesystem:     volume.Filesystem,
+	}
+}
+
+// CreateVolume создает, форматирует и закрывает именованный том арендатора.
+func (o *Orchestrator) CreateVolume(ctx context.Context, req agenttypes.CreateVolumeRequest) (*agenttypes.PersistentVolume, error) {
+	if req.Name == "" || req.TenantID == "" {
+		return nil, fmt.Errorf("%w: name and tenant_id are required", agenttypes.ErrInvalidRequest)
+	}
+	if req.SizeGB <= 0 {
+		return nil, fmt.Errorf("%w: size_gb must be positive", agenttypes.ErrInvalidRequest)
+	}
+	provider := o.volumes[o.volume]
+	if req.Filesystem != nil && provider.Name() == VolumeDirectory {
+		return nil, fmt.Errorf("%w: filesystem options are not supported by %s volumes", agenttypes.ErrInvalidRequest, VolumeDirectory)
+	}
+	filesystem, err := instanceFilesystem(o.filesystem, req.Filesystem)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+	}
+
+	o.namedMu.Lock()
+	defer o.namedMu.Unlock()
+
+	for _, existing := range storage.ListVolumes() {
+		if existing.TenantID == req.TenantID && existing.Name == req.Name {
+			return nil, fmt.Errorf("%w: tenant already has a volume named %q (%s)", agenttypes.ErrInvalidRequest, req.Name, existing.VolumeID)
+		}
+	}
+
+	releaseStorage, err := o.reserveStorage(ctx, provider, int64(req.SizeGB)<<30)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseStorage()
+
+	volumeID := storage.VolumeIDPrefix + uuid.New().String()
+	volume := &agenttypes.PersistentVolume{
+		VolumeID:       volumeID,
+		Name:           req.Name,
+		TenantID:       req.TenantID,
+		SizeGB:         req.SizeGB,
+		VolumeProvider: provider.Name(),
+		Filesystem:     filesystem,
+		MountPoint:     namedVolumeMountPoint(volumeID),
+		CreatedAt:      time.Now().UTC(),
+	}
+	state := namedVolumeState(volume)
+	provider.Prepare(state)
+	volume.DevicePath = state.LuksDevicePath
+	volume.MapperName = state.LuksMapperName
+
+	// Метаданные пишутся до создания устройства, чтобы недосозданный том можно было удалить.
+	if err := storage.SaveVolume(volume); err != nil {
+		return nil, fmt.Errorf("failed to persist volume: %w", err)
+	}
+	if err := provider.Create(ctx, state, req.SizeGB); err != nil {
+		if derr := o.destroyNamedVolume(ctx, volume); derr != nil {
+			log.Printf("ERROR: failed to clean up volume %s: %v", volumeID, derr)
+		}
+		return nil, fmt.Errorf("volume error: %w", err)
+	}
+	if err := provider.Close(ctx, state); err != nil {
+		log.Printf("Warning: failed to close new volume %s: %v", volumeID, err)
+	}
+
+	log.Printf("Volume %s (%q, tenant %s, %dG) created", volumeID, req.Name, req.TenantID, req.SizeGB)
+	return volume, nil
+}
+
+// ListVolumes возвращает именованные тома; с непустым tenantID — только тома этого арендатора.
+func (o *Orchestrator) ListVolumes(tenantID string) []agenttypes.PersistentVolume {
+	volumes := storage.ListVolumes()
+	if tenantID == "" {
+		return volumes
+	}
+	owned := []agenttypes.PersistentVolume{}
+	for _, volume := range volumes {
+		if volume.TenantID == tenantID {
+			owned = append(owned, volume)
+		}
+	}
+	return owned
+}
+
+// GetVolume возвращает том арендатора tenantID.
+func (o *Orchestrator) GetVolume(tenantID, volumeID string) (*agenttypes.PersistentVolume, error) {
+	volume, err := tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	return &volume, nil
+}
+
+// DeleteVolume уничтожает отключенный именованный том арендатора с выдачей сертификата удаления.
+func (o *Orchestrator) DeleteVolume(ctx context.Context, tenantID, volumeID string) error {
+	o.namedMu.Lock()
+	defer o.namedMu.Unlock()
+
+	volume, err := tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return err
+	}
+	if volume.AttachedTo != "" {
+		return fmt.Errorf("%w: volume %s is attached to instance %s", agenttypes.ErrInvalidTransition, volumeID, volume.AttachedTo)
+	}
+	return o.destroyNamedVolume(ctx, &volume)
+}
+
+// tenantVolume находит том арендатора. Чужой том неотличим от несуществующего.
+func tenantVolume(tenantID, volumeID string) (agenttypes.PersistentVolume, error) {
+	volume, ok := storage.GetVolume(volumeID)
+	if !ok || volume.TenantID != tenantID {
+		return volume, fmt.Errorf("%w: %s", agenttypes.ErrVolumeNotFound, volumeID)
+	}
+	return volume, nil
+}
+
+func (o *Orchestrator) destroyNamedVolume(ctx context.Context, volume *agenttypes.PersistentVolume) error {
+	cert, err := o.volumeFor(namedVolumeState(volume)).Destroy(ctx, namedVolumeState(volume))
+	if cert != nil {
+		cert.VolumeID, cert.InstanceID = cert.InstanceID, ""
+		o.issueDeletionCertificate(cert)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to destroy volume %s: %w", volume.VolumeID, err)
+	}
+	return storage.ClearVolume(volume.VolumeID)
+}
+
+// attachVolumes проверяет запрошенные тома и закрепляет их за инстансом до его создания.
+func (o *Orchestrator) attachVolumes(instanceID string, req *agenttypes.CreateInstanceRequest, encrypted bool) error {
+	if len(req.Volumes) == 0 {
+		return nil
+	}
+	if req.TenantID == "" {
+		return fmt.Errorf("%w: tenant_id is required to attach volumes", agenttypes.ErrInvalidRequest)
+	}
+
+	o.namedMu.Lock()
+	defer o.namedMu.Unlock()
+
+	seenVolumes := make(map[string]bool)
+	seenPaths := map[string]bool{containerDataPath: true}
+	var volumes []agenttypes.PersistentVolume
+	for i, attachment := range req.Volumes {
+		mountPath, err := cleanMountPath(attachment.MountPath)
+		if err != nil {
+			return err
+		}
+		if seenPaths[mountPath] {
+			return fmt.Errorf("%w: mount_path %s is used twice", agenttypes.ErrInvalidRequest, mountPath)
+		}
+		if seenVolumes[attachment.VolumeID] {
+			return fmt.Errorf("%w: volume %s is attached twice", agenttypes.ErrInvalidRequest, attachment.VolumeID)
+		}
+		seenPaths[mountPath] = true
+		seenVolumes[attachment.VolumeID] = true
+		req.Volumes[i].MountPath = mountPath
+
+		volume, err := o.attachableVolume(req.TenantID, attachment.VolumeID, encrypted)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, volume)
+	}
+
+	for i := range volumes {
+		volumes[i].AttachedTo = instanceID
+		if err := storage.SaveVolume(&volumes[i]); err != nil {
+			for _, attached := range volumes[:i] {
+				attached.AttachedTo = ""
+				storage.SaveVolume(&attached)
+			}
+			return fmt.Errorf("failed to persist volume attachment: %w", err)
+		}
+	}
+	return nil
+}
+
+// cleanMountPath приводит путь монтирования тома в контейнере к каноническому виду.
+func cleanMountPath(mountPath string) (string, error) {
+	cleaned := path.Clean(mountPath)
+	if !path.IsAbs(cleaned) || cleaned == "/" {
+		return "", fmt.Errorf("%w: volume mount_path must be an absolute path below /, got %q", agenttypes.ErrInvalidRequest, mountPath)
+	}
+	return cleaned, nil
+}
+
+// attachableVolume проверяет, что том арендатора свободен и подходит инстансу. Вызывается под namedMu.
+func (o *Orchestrator) attachableVolume(tenantID, volumeID string, encrypted bool) (agenttypes.PersistentVolume, error) {
+	volume, err := tenantVolume(tenantID, volumeID)
+	if err != nil {
+		return volume, err
+	}
+	if volume.AttachedTo != "" {
+		return volume, fmt.Errorf("%w: volume %s is attached to instance %s", agenttypes.ErrInvalidTransition, volume.VolumeID, volume.AttachedTo)
+	}
+	if encrypted && !o.volumeFor(namedVolumeState(&volume)).Encrypted() {
+		return volume, fmt.Errorf("%w: volume %s is not encrypted", agenttypes.ErrInvalidRequest, volume.VolumeID)
+	}
+	return volume, nil
+}
+
+// AttachVolume подключает том арендатора к остановленному инстансу. Docker не меняет монтирования
+// существующего контейнера, поэтому контейнер пересоздается с теми же настройками и новым томом.
+func (o *Orchestrator) AttachVolume(ctx context.Context, instanceID string, attachment agenttypes.VolumeAttachment) (*agenttypes.PersistentVolume, error) {
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, err := activeState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVolumesChangeable(&state); err != nil {
+		return nil, err
+	}
+	if state.TenantID == "" {
+		return nil, fmt.Errorf("%w: instance %s has no tenant to attach volumes of", agenttypes.ErrInvalidRequest, instanceID)
+	}
+	if attachment.MountPath, err = cleanMountPath(attachment.MountPath); err != nil {
+		return nil, err
+	}
+	if attachment.MountPath == containerDataPath {
+		return nil, fmt.Errorf("%w: mount_path %s is used by the instance volume", agenttypes.ErrInvalidRequest, containerDataPath)
+	}
+	for _, attached := range state.Volumes {
+		if attached.MountPath == attachment.MountPath {
+			return nil, fmt.Errorf("%w: mount_path %s is used by volume %s", agenttypes.ErrInvalidRequest, attachment.MountPath, attached.VolumeID)
+		}
+	}
+
+	o.namedMu.Lock()
+	volume, err := o.attachableVolume(state.TenantID, attachment.VolumeID, o.volumeFor(&state).Encrypted())
+	if err == nil {
+		volume.AttachedTo = instanceID
+		if err = storage.SaveVolume(&volume); err != nil {
+			err = fmt.Errorf("failed to persist volume attachment: %w", err)
+		}
+	}
+	o.namedMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := append(slices.Clone(state.Volumes), attachment)
+	volumeState := namedVolumeState(&volume)
+	err = o.volumeFor(volumeState).Open(ctx, volumeState)
+	if err != nil {
+		err = fmt.Errorf("failed to open volume %s: %w", volume.VolumeID, err)
+	} else {
+		err = o.replaceContainerVolumes(ctx, &state, volumes)
+	}
+	if err != nil {
+		o.namedMu.Lock()
+		if derr := o.detachVolume(ctx, instanceID, volume.VolumeID); derr != nil {
+			log.Printf("ERROR: failed to release volume %s after failed attach: %v", volume.VolumeID, derr)
+		}
+		o.namedMu.Unlock()
+		return nil, err
+	}
+
+	log.Printf("Volume %s attached to instance %s at %s", volume.VolumeID, instanceID, attachment.MountPath)
+	return &volume, nil
+}
+
+// DetachVolume отключает том от остановленного инстанса, пересоздавая контейнер без него.
+func (o *Orchestrator) DetachVolume(ctx context.Context, instanceID, volumeID string) error {
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, err := activeState(instanceID)
+	if err != nil {
+		return err
+	}
+	if err := checkVolumesChangeable(&state); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(state.Volumes, func(attached agenttypes.VolumeAttachment) bool { return attached.VolumeID == volumeID })
+	if i < 0 {
+		return fmt.Errorf("%w: %s is not attached to instance %s", agenttypes.ErrVolumeNotFound, volumeID, instanceID)
+	}
+
+	volumes := slices.Delete(slices.Clone(state.Volumes), i, i+1)
+	if err := o.replaceContainerVolumes(ctx, &state, volumes); err != nil {
+		return err
+	}
+
+	o.namedMu.Lock()
+	defer o.namedMu.Unlock()
+	if err := o.detachVolume(ctx, instanceID, volumeID); err != nil {
+		return err
+	}
+	log.Printf("Volume %s detached from instance %s", volumeID, instanceID)
+	return nil
+}
+
+// checkVolumesChangeable разрешает менять тома только у инстанса, остановленного по запросу.
+func checkVolumesChangeable(state *agenttypes.InstanceState) error {
+	if state.Status != agenttypes.StatusPaused {
+		return fmt.Errorf("%w: instance %s is %s, stop it to change volumes", agenttypes.ErrInvalidTransition, state.InstanceID, state.Status)
+	}
+	return nil
+}
+
+// replaceContainerVolumes пересоздает контейнер инстанса с набором томов volumes и сохраняет состояние.
+func (o *Orchestrator) replaceContainerVolumes(ctx context.Context, state *agenttypes.InstanceState, volumes []agenttypes.VolumeAttachment) error {
+	containerID, err := recreateContainer(ctx, o.dockerCli, state.ContainerID, volumes)
+	if err != nil {
+		return err
+	}
+	state.ContainerID = containerID
+	state.Volumes = volumes
+	if err := storage.SaveState(state); err != nil {
+		return fmt.Errorf("failed to persist state: %w", err)
+	}
+	return nil
+}
+
+// openAttachedVolumes открывает и монтирует подключенные к инстансу тома.
+func (o *Orchestrator) openAttachedVolumes(ctx context.Context, state *agenttypes.InstanceState) error {
+	for _, attachment := range state.Volumes {
+		volume, ok := storage.GetVolume(attachment.VolumeID)
+		if !ok {
+			return fmt.Errorf("%w: %s", agenttypes.ErrVolumeNotFound, attachment.VolumeID)
+		}
+		volumeState := namedVolumeState(&volume)
+		if err := o.volumeFor(volumeState).Open(ctx, volumeState); err != nil {
+			return fmt.Errorf("failed to open volume %s of instance %s: %w", volume.VolumeID, state.InstanceID, err)
+		}
+	}
+	return nil
+}
+
+// detachVolumes закрывает тома инстанса и освобождает их для других инстансов арендатора.
+// Том, который не удалось закрыть, остается закрепленным за инстансом.
+func (o *Orchestrator) detachVolumes(ctx context.Context, state *agenttypes.InstanceState) error {
+	o.namedMu.Lock()
+	defer o.namedMu.Unlock()
+
+	var errs []error
+	for _, attachment := range state.Volumes {
+		if err := o.detachVolume(ctx, state.InstanceID, attachment.VolumeID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// detachVolume закрывает том и снимает его закрепление за инстансом. Вызывается под namedMu.
+func (o *Orchestrator) detachVolume(ctx context.Context, instanceID, volumeID string) error {
+	volume, ok := storage.GetVolume(volumeID)
+	if !ok || volume.AttachedTo != instanceID {
+		return nil
+	}
+	volumeState := namedVolumeState(&volume)
+	if err := o.volumeFor(volumeState).Close(ctx, volumeState); err != nil {
+		return fmt.Errorf("failed to close volume %s: %w", volume.VolumeID, err)
+	}
+	volume.AttachedTo = ""
+	if err := storage.SaveVolume(&volume); err != nil {
+		return fmt.Errorf("failed to persist detach of volume %s: %w", volume.VolumeID, err)
+	}
+	return nil
+}
@@ -3,75 +3,115 @@ package orchestrator
 import (
 	"context"
 	"fmt"
-	"strings"
+	"log"
+	"net"
+	"net/netip"
 
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
-	"github.com/nociriysname/qudata-agent/internal/utils"
+
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
 )
 
-// Стандартные приватные сети, доступ к которым нужно заблокировать.
-var privateNetworks = []string{"192.168.0.0/16", "10.0.0.0/8", "172.16.0.0/12"}
+// containerAddrs — адреса контейнера в сетях Docker. IPv6 есть только при включенном ipv6 в Docker.
+type containerAddrs struct {
+	IPv4 string
+	IPv6 string
+}
+
+func (a containerAddrs) String() string {
+	if a.IPv6 == "" {
+		return a.IPv4
+	}
+	return a.IPv4 + ", " + a.IPv6
+}
 
-func getContainerIP(ctx context.Context, cli *client.Client, containerID string) (string, error) {
+func getContainerAddrs(ctx context.Context, cli *client.Client, containerID string) (containerAddrs, error) {
+	var addrs containerAddrs
 	if containerID == "" {
-		return "", fmt.Errorf("container ID is empty")
+		return addrs, fmt.Errorf("container ID is empty")
 	}
 
 	json, err := cli.ContainerInspect(ctx, containerID)
 	if err != nil {
-		return "", fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+		return addrs, fmt.Errorf("failed to inspect container %s: %w", containerID, err)
 	}
 
 	for _, network := range json.NetworkSettings.Networks {
 		if network.IPAddress != "" {
-			return network.IPAddress, nil
+			addrs.IPv4 = network.IPAddress
+			addrs.IPv6 = network.GlobalIPv6Address
+			return addrs, nil
 		}
 	}
 
-	return "", fmt.Errorf("no IP address found for container %s", containerID)
+	return addrs, fmt.Errorf("no IP address found for container %s", containerID)
 }
 
-func applyNetworkIsolation(ctx context.Context, containerIP string) error {
-	if containerIP == "" {
-		return fmt.Errorf("cannot apply network isolation for empty IP")
+// hostAddresses возвращает адреса всех интерфейсов хоста.
+func hostAddresses() ([]netip.Addr, error) {
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host addresses: %w", err)
+	}
+	var addrs []netip.Addr
+	for _, addr := range ifaceAddrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipNet.IP); ok {
+				addrs = append(addrs, ip.Unmap())
+			}
+		}
 	}
+	return addrs, nil
+}
 
-	chain := "DOCKER-USER"
+// instanceRules собирает правила firewall инстанса: исходящий трафик, затем доступ к портам.
+func instanceRules(state *agenttypes.InstanceState) []firewallRule {
+	return append(compileEgress(state.Egress), compileInbound(state.PortAccess)...)
+}
 
-	for _, network := range privateNetworks {
-		args := []string{
-			"-I", chain,
-			"-s", containerIP,
-			"-d", network,
-			"-j", "REJECT",
-		}
-		if err := utils.RunCommand(ctx, "", "iptables", args...); err != nil && !strings.Contains(err.Error(), "rule already exists") {
-			return fmt.Errorf("failed to apply iptables rule for network %s: %w", network, err)
+// isolateInstance применяет к контейнеру инстанса его правила firewall. Docker выдает
+// IP при каждом старте заново; firewall заменяет правила прежнего IP.
+func (o *Orchestrator) isolateInstance(ctx context.Context, state *agenttypes.InstanceState) error {
+	addrs, err := getContainerAddrs(ctx, o.dockerCli, state.ContainerID)
+	if err != nil {
+		return err
+	}
+	if state.Egress.Version < egressPolicyVersion {
+		// Инстанс создан до появления политики: берем политику хоста.
+		if state.Egress, err = o.egress.resolve(nil); err != nil {
+			return err
 		}
 	}
-	fmt.Printf("Applied network isolation for IP %s\n", containerIP)
+	if err := o.firewall.Apply(ctx, state.InstanceID, addrs, instanceRules(state)); err != nil {
+		return err
+	}
+	state.IsolatedIP = addrs.IPv4
+	state.IsolatedIPv6 = addrs.IPv6
+	log.Printf("Applied network isolation for instance %s (%s, %s)", state.InstanceID, addrs, o.firewall.Name())
 	return nil
 }
 
-func removeNetworkIsolation(ctx context.Context, containerIP string) error {
-	if containerIP == "" {
-		return nil
+// startContainer запускает контейнер инстанса, сразу изолирует его и запоминает порты хоста.
+func (o *Orchestrator) startContainer(ctx context.Context, state *agenttypes.InstanceState) error {
+	if err := o.dockerCli.ContainerStart(ctx, state.ContainerID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("failed to start container %s: %w", state.ContainerID, err)
 	}
+	if err := o.isolateStarted(ctx, state); err != nil {
+		return err
+	}
+	o.recordPublishedPorts(ctx, state)
+	return nil
+}
 
-	chain := "DOCKER-USER"
-
-	for _, network := range privateNetworks {
-		args := []string{
-			"-D", chain,
-			"-s", containerIP,
-			"-d", network,
-			"-j", "REJECT",
-		}
-
-		if err := utils.RunCommand(ctx, "", "iptables", args...); err != nil && !strings.Contains(err.Error(), "does not exist") {
-			fmt.Printf("Warning: failed to remove iptables rule for IP %s, network %s: %v\n", containerIP, network, err)
+// isolateStarted изолирует только что запущенный контейнер. Контейнер без изоляции работать
+// не должен, поэтому при ошибке он убивается.
+func (o *Orchestrator) isolateStarted(ctx context.Context, state *agenttypes.InstanceState) error {
+	if err := o.isolateInstance(ctx, state); err != nil {
+		if kerr := o.dockerCli.ContainerKill(ctx, state.ContainerID, "SIGKILL"); kerr != nil {
+			log.Printf("ERROR: failed to kill non-isolated container %s: %v", state.ContainerID, kerr)
 		}
+		return fmt.Errorf("network isolation failed: %w", err)
 	}
-	fmt.Printf("Removed network isolation for IP %s\n", containerIP)
 	return nil
 }
@@ -0,0 +1,133 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nociriysname/qudata-agent/internal/utils"
+)
+
+const (
+	// nftTable — таблица агента; в чужие таблицы агент не пишет.
+	nftTable = "qudata"
+	// nftPriority — цепочки инстансов срабатывают раньше фильтров Docker (priority filter = 0).
+	nftPriority = -10
+)
+
+// nftablesFirewall держит правила каждого инстанса в отдельной базовой цепочке на хуке forward.
+// Цепочка пересоздается целиком одной транзакцией nft -f, поэтому правила не бывают
+// применены наполовину, а смена IP не оставляет окна без изоляции.
+type nftablesFirewall struct{}
+
+func (f *nftablesFirewall) Name() string { return FirewallNftables }
+
+// chain возвращает имя цепочки инстанса; дефисы UUID заменяются, чтобы имя было идентификатором nft.
+func (f *nftablesFirewall) chain(instanceID string) string {
+	return "inst_" + strings.ReplaceAll(instanceID, "-", "_")
+}
+
+// expressions возвращает выражения nft для правила: по одному на каждое семейство адресов контейнера.
+func (f *nftablesFirewall) expressions(addrs containerAddrs, rule firewallRule) []string {
+	verdict := "reject"
+	if rule.accept {
+		verdict = "return"
+	}
+	// Для исходящего трафика контейнер — источник пакета, для входящего — назначение.
+	self, peer := "saddr", "daddr"
+	if rule.inbound {
+		self, peer = peer, self
+	}
+
+	var exprs []string
+	for _, family := range []struct {
+		proto, addr string
+		v6          bool
+	}{{"ip", addrs.IPv4, false}, {"ip6", addrs.IPv6, true}} {
+		if family.addr == "" || !rule.family(family.v6) {
+			continue
+		}
+		expr := fmt.Sprintf("%s %s %s", family.proto, self, family.addr)
+		if rule.proto != "" {
+			expr += fmt.Sprintf(" %s dport %s", rule.proto, rule.portRange("-"))
+		}
+		if rule.peer.IsValid() {
+			expr += fmt.Sprintf(" %s %s %s", family.proto, peer, rule.peerString())
+		}
+		exprs = append(exprs, expr+" "+verdict)
+	}
+	return exprs
+}
+
+func (f *nftablesFirewall) Apply(ctx context.Context, instanceID string, addrs containerAddrs, rules []firewallRule) error {
+	if addrs.IPv4 == "" {
+		return fmt.Errorf("cannot apply network isolation for empty IP")
+	}
+	chain := f.chain(instanceID)
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table inet %s\n", nftTable)
+	fmt.Fprintf(&script, "add chain inet %s %s { type filter hook forward priority %d; policy accept; }\n", nftTable, chain, nftPriority)
+	fmt.Fprintf(&script, "flush chain inet %s %s\n", nftTable, chain)
+	for _, rule := range rules {
+		for _, expr := range f.expressions(addrs, rule) {
+			fmt.Fprintf(&script, "add rule inet %s %s %s\n", nftTable, chain, expr)
+		}
+	}
+
+	if err := utils.RunCommand(ctx, script.String(), "nft", "-f", "-"); err != nil {
+		return fmt.Errorf("failed to apply nftables rules: %w", err)
+	}
+	return nil
+}
+
+func (f *nftablesFirewall) Remove(ctx context.Context, instanceID string) error {
+	chain := f.chain(instanceID)
+
+	// add перед delete делает удаление идемпотентным: несуществующая цепочка создается и сразу удаляется.
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table inet %s\n", nftTable)
+	fmt.Fprintf(&script, "add chain inet %s %s\n", nftTable, chain)
+	fmt.Fprintf(&script, "flush chain inet %s %s\n", nftTable, chain)
+	fmt.Fprintf(&script, "delete chain inet %s %s\n", nftTable, chain)
+
+	if err := utils.RunCommand(ctx, script.String(), "nft", "-f", "-"); err != nil {
+		return fmt.Errorf("failed to remove nftables chain %s: %w", chain, err)
+	}
+	return nil
+}
+
+func (f *nftablesFirewall) Missing(ctx context.Context, instanceID string, addrs containerAddrs, rules []firewallRule) []firewallRule {
+	out, err := utils.RunCommandGetOutput(ctx, "", "nft", "list", "chain", "inet", nftTable, f.chain(instanceID))
+	if err != nil {
+		return rules
+	}
+
+	var missing []firewallRule
+	for _, rule := range rules {
+		for _, expr := range f.expressions(addrs, rule) {
+			if !nftHasRule(out, expr) {
+				missing = append(missing, rule)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// nftHasRule ищет в выводе nft list строку правила, содержащую все части.
+func nftHasRule(listing string, parts ...string) bool {
+	for _, line := range strings.Split(listing, "\n") {
+		found := true
+		for _, part := range parts {
+			if !strings.Contains(line, part) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
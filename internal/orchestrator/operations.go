@@ -0,0 +1,87 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// operationTracker обновляет запись операции по мере выполнения шагов.
+type operationTracker struct {
+	op agenttypes.Operation
+}
+
+// Progress фиксирует процент выполнения и текущий шаг операции.
+func (t *operationTracker) Progress(percent int, message string) {
+	t.op.Progress = percent
+	t.op.Message = message
+	t.save()
+}
+
+func (t *operationTracker) finish(err error) {
+	now := time.Now().UTC()
+	t.op.FinishedAt = &now
+	if err != nil {
+		t.op.Phase = agenttypes.PhaseFailed
+		t.op.Error = err.Error()
+		// Отказ политики допуска отдается бэкенду в том же виде, что и синхронный 403.
+		var rejection *agenttypes.AdmissionError
+		if errors.As(err, &rejection) {
+			t.op.Rejection = rejection
+		}
+	} else {
+		t.op.Phase = agenttypes.PhaseSucceeded
+		t.op.Progress = 100
+	}
+	t.save()
+}
+
+func (t *operationTracker) save() {
+	t.op.UpdatedAt = time.Now().UTC()
+	if err := storage.SaveOperation(&t.op); err != nil {
+		log.Printf("Warning: failed to persist operation %s: %v", t.op.OperationID, err)
+	}
+}
+
+// startOperation регистрирует операцию и выполняет run в фоне с собственным контекстом,
+// не зависящим от HTTP-запроса, который ее инициировал.
+func (o *Orchestrator) startOperation(opType agenttypes.OperationType, instanceID string, run func(ctx context.Context, t *operationTracker) error) *agenttypes.Operation {
+	now := time.Now().UTC()
+	t := &operationTracker{op: agenttypes.Operation{
+		OperationID: uuid.New().String(),
+		Type:        opType,
+		InstanceID:  instanceID,
+		Phase:       agenttypes.PhasePending,
+		CreatedAt:   now,
+	}}
+	t.save()
+	op := t.op
+
+	go func() {
+		t.op.Phase = agenttypes.PhaseRunning
+		t.save()
+
+		err := run(context.Background(), t)
+		if err != nil {
+			log.Printf("ERROR: %s operation %s for instance %s failed: %v", opType, t.op.OperationID, instanceID, err)
+		}
+		t.finish(err)
+	}()
+
+	return &op
+}
+
+func (o *Orchestrator) GetOperation(operationID string) (*agenttypes.Operation, error) {
+	op, ok := storage.GetOperation(operationID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", agenttypes.ErrOperationNotFound, operationID)
+	}
+	return &op, nil
+}
@@ -3,16 +3,22 @@ package orchestrator
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/google/uuid"
 
+	"github.com/nociriysname/qudata-agent/internal/admission"
+	"github.com/nociriysname/qudata-agent/internal/cfg"
+	"github.com/nociriysname/qudata-agent/internal/keystore"
 	"github.com/nociriysname/qudata-agent/internal/storage"
 	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
 )
@@ -24,14 +30,64 @@ const (
 
 type QudataClient interface {
 	NotifyInstanceReady(instanceID string) error
+	ReportPullProgress(instanceID string, progress agenttypes.PullProgress) error
+	ReportAdmissionRejection(rejection agenttypes.AdmissionError) error
+	ReportDrift(drifts []agenttypes.Drift) error
+	ReportLifecycleEvent(event agenttypes.LifecycleEvent) error
+	ReportDeletionCertificate(cert agenttypes.DeletionCertificate) error
+	ReportInstanceIncident(instanceID, incidentType, reason string) error
+	FetchKEK() ([]byte, error)
 }
 
 type Orchestrator struct {
-	dockerCli *client.Client
-	qudataCli QudataClient
+	dockerCli  *client.Client
+	qudataCli  QudataClient
+	gpus       *GPUAllocator
+	admission  *admission.Policy
+	keys       *keystore.Keystore
+	volumes    map[string]VolumeProvider
+	volume     string // поставщик томов для новых инстансов
+	filesystem agenttypes.FilesystemOptions
+	accountant *storageAccountant
+	firewall   Firewall
+	egress     *egressPolicy
+	locks      sync.Map
+	namedMu    sync.Mutex // подключение, отключение и удаление именованных томов
+	snapshotMu sync.Mutex
+	snapshots  map[string]int // snapshotID -> число восстановлений, читающих снапшот
+	pulls      sync.Map       // instanceID -> *pullTracker
 }
 
-func New(qClient QudataClient) (*Orchestrator, error) {
+func New(qClient QudataClient, conf *cfg.Config) (*Orchestrator, error) {
+	policy, err := admission.NewPolicy(conf.Admission)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := keystore.New(conf.Keys, qClient)
+	if err != nil {
+		return nil, err
+	}
+	volumes, volume, err := newVolumeProviders(conf.Storage, keys)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := instanceFilesystem(conf.Storage.Filesystem, nil); err != nil {
+		return nil, fmt.Errorf("storage: %w", err)
+	}
+	accountant, err := newStorageAccountant(conf.Storage.SafetyMarginPercent)
+	if err != nil {
+		return nil, err
+	}
+	firewall, err := newFirewall(context.Background(), conf.Network)
+	if err != nil {
+		return nil, err
+	}
+	egress, err := newEgressPolicy(conf.Network.Egress)
+	if err != nil {
+		return nil, err
+	}
+
 	customHeaders := map[string]string{"X-Qudata-Agent": "true"}
 
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation(), client.WithHTTPHeaders(customHeaders))
@@ -46,146 +102,485 @@ func New(qClient QudataClient) (*Orchestrator, error) {
 	os.MkdirAll(storageDir, 0755)
 	os.MkdirAll(mountDir, 0755)
 
-	return &Orchestrator{dockerCli: cli, qudataCli: qClient}, nil
+	return &Orchestrator{
+		dockerCli:  cli,
+		qudataCli:  qClient,
+		gpus:       NewGPUAllocator(),
+		admission:  policy,
+		keys:       keys,
+		volumes:    volumes,
+		volume:     volume,
+		filesystem: conf.Storage.Filesystem,
+		accountant: accountant,
+		firewall:   firewall,
+		egress:     egress,
+		snapshots:  make(map[string]int),
+	}, nil
 }
 
-func (o *Orchestrator) CreateInstance(ctx context.Context, req agenttypes.CreateInstanceRequest) (*agenttypes.InstanceState, error) {
-	currentState := storage.GetState()
-	if currentState.Status != "destroyed" && currentState.Status != "" {
-		return nil, fmt.Errorf("an instance '%s' is already running", currentState.InstanceID)
+// lockInstance сериализует операции над одним инстансом; разные инстансы не блокируют друг друга.
+func (o *Orchestrator) lockInstance(instanceID string) func() {
+	m, _ := o.locks.LoadOrStore(instanceID, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// activeState возвращает состояние инстанса или ErrInstanceNotFound.
+func activeState(instanceID string) (agenttypes.InstanceState, error) {
+	state, ok := storage.GetState(instanceID)
+	if !ok {
+		return agenttypes.InstanceState{}, fmt.Errorf("%w: %s", agenttypes.ErrInstanceNotFound, instanceID)
+	}
+	return state, nil
+}
+
+// CreateInstance регистрирует инстанс и запускает его создание в фоне.
+// Возвращает операцию, по которой бэкенд отслеживает прогресс.
+func (o *Orchestrator) CreateInstance(ctx context.Context, req agenttypes.CreateInstanceRequest) (*agenttypes.Operation, error) {
+	if req.Image == "" {
+		return nil, fmt.Errorf("%w: image is required", agenttypes.ErrInvalidRequest)
+	}
+	if req.RegistryAuth != nil {
+		if err := req.RegistryAuth.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+		}
 	}
 
+	if err := validateResources(&req); err != nil {
+		return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+	}
+	if err := validateRestartPolicy(req.RestartPolicy); err != nil {
+		return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+	}
+	volume := o.volumes[o.volume]
+	if req.IsConfidential && !volume.Encrypted() {
+		return nil, fmt.Errorf("%w: confidential instances need an encrypted volume, host uses %s", agenttypes.ErrInvalidRequest, o.volume)
+	}
+	if req.Filesystem != nil && volume.Name() == VolumeDirectory {
+		return nil, fmt.Errorf("%w: filesystem options are not supported by %s volumes", agenttypes.ErrInvalidRequest, VolumeDirectory)
+	}
+	filesystem, err := instanceFilesystem(o.filesystem, req.Filesystem)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+	}
+	egress, err := o.egress.resolve(req.Egress)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+	}
+	ports, err := parsePorts(req.Ports)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+	}
+	portAccess, err := resolvePortAccess(&req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", agenttypes.ErrInvalidRequest, err)
+	}
+	if req.SnapshotID != "" {
+		snapshot, err := o.snapshotForCreate(&req)
+		if err != nil {
+			return nil, err
+		}
+		filesystem = snapshot.Filesystem
+	}
+	if err := o.admission.CheckReference(instanceImageName(&req), req.ImageSignature); err != nil {
+		o.reportAdmissionRejection("", err)
+		return nil, err
+	}
+
+	// Резерв держится до сохранения состояния: дальше размер тома учитывается по нему.
+	releaseStorage, err := o.reserveStorage(ctx, volume, int64(req.StorageGB)<<30)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseStorage()
+
 	instanceID := uuid.New().String()
+	if err := o.attachVolumes(instanceID, &req, volume.Encrypted()); err != nil {
+		return nil, err
+	}
 	newState := &agenttypes.InstanceState{
 		InstanceID:     instanceID,
-		Status:         "pending",
-		LuksDevicePath: filepath.Join(storageDir, fmt.Sprintf("%s.img", instanceID)),
-		LuksMapperName: fmt.Sprintf("qudata-%s", instanceID),
+		TenantID:       req.TenantID,
+		Image:          instanceImageName(&req),
+		Volumes:        req.Volumes,
+		VolumeProvider: o.volume,
+		Filesystem:     filesystem,
 		MountPoint:     filepath.Join(mountDir, instanceID),
-		AllocatedPorts: req.Ports,
+		StorageGB:      req.StorageGB,
+		AllocatedPorts: resolvePorts(ports),
+		Egress:         egress,
+		PortAccess:     portAccess,
+		RestartPolicy:  requestRestartPolicy(&req),
+	}
+	o.volumeFor(newState).Prepare(newState)
+	newState.InitStatus(agenttypes.StatusPending)
+	if err := storage.SaveState(newState); err != nil {
+		o.detachVolumes(context.Background(), newState)
+		return nil, fmt.Errorf("failed to persist state: %w", err)
+	}
+
+	op := o.startOperation(agenttypes.OperationCreate, instanceID, func(ctx context.Context, t *operationTracker) error {
+		return o.createInstance(ctx, t, newState, req)
+	})
+	return op, nil
+}
+
+func (o *Orchestrator) createInstance(ctx context.Context, t *operationTracker, newState *agenttypes.InstanceState, req agenttypes.CreateInstanceRequest) error {
+	unlock := o.lockInstance(newState.InstanceID)
+	defer unlock()
+
+	journal := newCreateJournal(t.op.OperationID, newState)
+	if err := o.runCreateSteps(ctx, t, journal, newState, &req); err != nil {
+		o.failCreate(ctx, newState, err)
+		return err
+	}
+
+	if err := newState.Transition(agenttypes.StatusRunning, "created"); err != nil {
+		return err
+	}
+	if err := storage.SaveState(newState); err != nil {
+		log.Printf("ERROR: failed to persist state of instance %s: %v", newState.InstanceID, err)
+	}
+	if err := storage.ClearJournal(newState.InstanceID); err != nil {
+		log.Printf("Warning: failed to clear create journal of instance %s: %v", newState.InstanceID, err)
+	}
+
+	if req.SSHEnabled {
+		go setupSSHInContainer(o.dockerCli, o.qudataCli, newState.InstanceID, newState.ContainerID)
 	}
 
+	return nil
+}
+
+// runCreateSteps выполняет шаги создания, фиксируя каждый в журнале.
+func (o *Orchestrator) runCreateSteps(ctx context.Context, t *operationTracker, journal *createJournal, newState *agenttypes.InstanceState, req *agenttypes.CreateInstanceRequest) error {
 	var deviceMappings []container.DeviceMapping
 	if req.GPUCount > 0 {
-		pci, origDriver, vfioPath, err := PrepareGPU(ctx)
+		t.Progress(5, "allocating GPUs")
+		err := journal.step(stepAllocateGPU, func() error {
+			devices, mappings, err := o.gpus.Allocate(ctx, newState.InstanceID, req.GPUCount)
+			if err != nil {
+				return fmt.Errorf("GPU error: %w", err)
+			}
+			newState.GPUDevices = devices
+			deviceMappings = mappings
+			return nil
+		})
 		if err != nil {
-			return nil, fmt.Errorf("GPU error: %w", err)
+			return err
 		}
-		newState.PciAddress = pci
-		newState.OriginalDriver = origDriver
+	}
 
-		deviceMappings = []container.DeviceMapping{
-			{PathOnHost: "/dev/vfio/vfio", PathInContainer: "/dev/vfio/vfio", CgroupPermissions: "rwm"},
-			{PathOnHost: vfioPath, PathInContainer: vfioPath, CgroupPermissions: "rwm"},
+	volume := o.volumeFor(newState)
+	t.Progress(15, fmt.Sprintf("creating %s volume", volume.Name()))
+	err := journal.step(stepCreateVolume, func() error {
+		if err := o.createVolume(ctx, volume, newState, req); err != nil {
+			return fmt.Errorf("volume error: %w", err)
 		}
+		return o.openAttachedVolumes(ctx, newState)
+	})
+	if err != nil {
+		return err
 	}
 
-	if err := createEncryptedVolume(ctx, newState, req.StorageGB); err != nil {
-		o.rollback(ctx, newState)
-		return nil, fmt.Errorf("LUKS error: %w", err)
+	imageName := instanceImageName(req)
+	var imageRef string
+	t.Progress(30, fmt.Sprintf("pulling image %s", imageName))
+	err = journal.step(stepPullImage, func() error {
+		if err := o.pullInstanceImage(ctx, t, newState.InstanceID, imageName, req.RegistryAuth); err != nil {
+			return err
+		}
+		t.Progress(80, "verifying image signature")
+		imageRef, err = o.verifyPulledImage(ctx, newState.InstanceID, imageName, req.ImageSignature)
+		return err
+	})
+	if err != nil {
+		return err
 	}
 
-	runtimeName := SelectRuntime(req.IsConfidential)
-	containerID, err := runContainer(ctx, o.dockerCli, &req, newState, deviceMappings, runtimeName)
+	t.Progress(85, "creating container")
+	err = journal.step(stepCreateContainer, func() error {
+		runtimeName := SelectRuntime(req.IsConfidential)
+		containerID, err := createContainer(ctx, o.dockerCli, req, imageRef, newState, deviceMappings, runtimeName)
+		if err != nil {
+			return fmt.Errorf("start failed: %w", err)
+		}
+		newState.ContainerID = containerID
+		newState.SSHEnabled = req.SSHEnabled
+		return storage.SaveState(newState)
+	})
 	if err != nil {
-		o.rollback(ctx, newState)
-		return nil, fmt.Errorf("start failed: %w", err)
+		return err
 	}
 
-	newState.ContainerID = containerID
-	newState.Status = "running"
-	storage.SaveState(newState)
+	t.Progress(95, "starting container")
+	return journal.step(stepStartContainer, func() error {
+		return o.startContainer(ctx, newState)
+	})
+}
 
-	if req.SSHEnabled {
-		go setupSSHInContainer(o.dockerCli, o.qudataCli, newState.ContainerID)
+// createVolume создает пустой том или восстанавливает его из снапшота.
+func (o *Orchestrator) createVolume(ctx context.Context, volume VolumeProvider, state *agenttypes.InstanceState, req *agenttypes.CreateInstanceRequest) error {
+	if req.SnapshotID == "" {
+		return volume.Create(ctx, state, req.StorageGB)
 	}
 
-	return newState, nil
+	snapshot, release, err := o.useSnapshot(req.SnapshotID)
+	if err != nil {
+		return err
+	}
+	defer release()
+	restorer, ok := volume.(snapshotVolume)
+	if !ok {
+		return fmt.Errorf("%s volumes do not support snapshots", volume.Name())
+	}
+	return restorer.Restore(ctx, state, snapshot, req.StorageGB)
 }
 
-func (o *Orchestrator) DeleteInstance(ctx context.Context) error {
-	state := storage.GetState()
-	if state.ContainerID == "" {
-		return nil
+func (o *Orchestrator) GetInstance(instanceID string) (*agenttypes.InstanceState, error) {
+	state, err := activeState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (o *Orchestrator) ListInstances() []agenttypes.InstanceState {
+	return storage.ListStates()
+}
+
+// DeleteInstance запускает удаление инстанса в фоне.
+func (o *Orchestrator) DeleteInstance(ctx context.Context, instanceID string) (*agenttypes.Operation, error) {
+	state, err := activeState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.CheckTransition(agenttypes.StatusDeleting); err != nil {
+		return nil, err
+	}
+
+	op := o.startOperation(agenttypes.OperationDelete, instanceID, func(ctx context.Context, t *operationTracker) error {
+		return o.deleteInstance(ctx, instanceID, false)
+	})
+	return op, nil
+}
+
+// deleteInstance удаляет инстанс. С force удаление выполняется из любого статуса (lockdown).
+func (o *Orchestrator) deleteInstance(ctx context.Context, instanceID string, force bool) error {
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, err := activeState(instanceID)
+	if err != nil {
+		return err
+	}
+	if err := state.Transition(agenttypes.StatusDeleting, "delete requested"); err != nil {
+		if !force {
+			return err
+		}
+		state.InitStatus(agenttypes.StatusDeleting)
+	}
+	// Статус deleting сохраняется, чтобы прерванное рестартом удаление было доведено до конца.
+	if err := storage.SaveState(&state); err != nil {
+		log.Printf("Warning: failed to persist deleting status of instance %s: %v", instanceID, err)
+	}
+
+	if err := o.rollback(ctx, &state); err != nil {
+		// Состояние остается, чтобы удаление можно было повторить.
+		state.Transition(agenttypes.StatusError, fmt.Sprintf("deletion failed: %v", err))
+		storage.SaveState(&state)
+		return fmt.Errorf("failed to delete instance %s: %w", instanceID, err)
 	}
-	o.rollback(ctx, &state)
 	return nil
 }
 
-func (o *Orchestrator) rollback(ctx context.Context, state *agenttypes.InstanceState) {
-	removeContainer(ctx, o.dockerCli, state.ContainerID)
-	deleteEncryptedVolume(ctx, state)
-	if state.PciAddress != "" {
-		ReturnGPUToHost(ctx, state.PciAddress, state.OriginalDriver)
+// DeleteAllInstances уничтожает все инстансы хоста (используется при lockdown).
+func (o *Orchestrator) DeleteAllInstances(ctx context.Context) error {
+	// Watchdog загрузил состояние при старте; инстансы, созданные позже, есть только на диске.
+	var errs []error
+	if err := storage.LoadState(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to reload state: %w", err))
+	}
+	o.gpus.Reload()
+	for _, state := range storage.ListStates() {
+		if err := o.deleteInstance(ctx, state.InstanceID, true); err != nil && !errors.Is(err, agenttypes.ErrInstanceNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rollback удаляет все ресурсы инстанса вместе с его состоянием. Если том не удалось
+// уничтожить, состояние сохраняется.
+func (o *Orchestrator) rollback(ctx context.Context, state *agenttypes.InstanceState) error {
+	if err := o.releaseResources(ctx, state); err != nil {
+		return err
 	}
-	storage.ClearState()
+	return storage.ClearState(state.InstanceID)
 }
 
-func (o *Orchestrator) ManageInstance(ctx context.Context, action agenttypes.InstanceAction) error {
-	state := storage.GetState()
+// failCreate освобождает ресурсы недосозданного инстанса и оставляет его в статусе failed
+// с причиной в истории, пока бэкенд явно его не удалит.
+func (o *Orchestrator) failCreate(ctx context.Context, state *agenttypes.InstanceState, cause error) {
+	if err := o.releaseResources(ctx, state); err != nil {
+		log.Printf("ERROR: failed to release resources of instance %s: %v", state.InstanceID, err)
+	}
+	state.ContainerID = ""
+	state.GPUDevices = nil
+	if err := state.Transition(agenttypes.StatusFailed, cause.Error()); err != nil {
+		state.InitStatus(agenttypes.StatusFailed)
+	}
+	if err := storage.SaveState(state); err != nil {
+		log.Printf("ERROR: failed to persist failed status of instance %s: %v", state.InstanceID, err)
+	}
+	if err := storage.ClearJournal(state.InstanceID); err != nil {
+		log.Printf("Warning: failed to clear create journal of instance %s: %v", state.InstanceID, err)
+	}
+}
+
+// releaseResources удаляет контейнеры, правила изоляции, том и GPU инстанса и отключает именованные тома. Каждый шаг идемпотентен,
+// поэтому освобождение безопасно и для частично созданного инстанса. Возвращает ошибку,
+// если том не удалось уничтожить.
+func (o *Orchestrator) releaseResources(ctx context.Context, state *agenttypes.InstanceState) error {
+	containerIDs, err := instanceContainers(ctx, o.dockerCli, state.InstanceID)
+	if err != nil {
+		log.Printf("Warning: failed to list containers of instance %s: %v", state.InstanceID, err)
+	}
+	if state.ContainerID != "" && !slices.Contains(containerIDs, state.ContainerID) {
+		containerIDs = append(containerIDs, state.ContainerID)
+	}
+	for _, containerID := range containerIDs {
+		removeContainer(ctx, o.dockerCli, containerID)
+	}
+	isolationErr := o.firewall.Remove(ctx, state.InstanceID)
+
+	cert, err := o.volumeFor(state).Destroy(ctx, state)
+	if cert != nil {
+		o.issueDeletionCertificate(cert)
+	}
+	if detachErr := o.detachVolumes(ctx, state); detachErr != nil {
+		err = errors.Join(err, detachErr)
+	}
+	if isolationErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to remove network isolation: %w", isolationErr))
+	}
+	o.gpus.Release(ctx, state.InstanceID)
+	o.pulls.Delete(state.InstanceID)
+	return err
+}
+
+// ManageInstance проверяет действие и выполняет его в фоне.
+func (o *Orchestrator) ManageInstance(ctx context.Context, instanceID string, action agenttypes.InstanceAction) (*agenttypes.Operation, error) {
+	target, ok := agenttypes.ActionTarget(action)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown action: %s", agenttypes.ErrInvalidRequest, action)
+	}
+
+	state, err := activeState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := state.CheckTransition(target); err != nil {
+		return nil, err
+	}
 	if state.ContainerID == "" {
-		return fmt.Errorf("no active instance")
+		return nil, fmt.Errorf("instance %s has no container", instanceID)
 	}
 
-	var err error
-	newStatus := state.Status
-	timeout := 10
+	op := o.startOperation(agenttypes.OperationManage, instanceID, func(ctx context.Context, t *operationTracker) error {
+		t.Progress(10, string(action))
+		return o.manageInstance(ctx, instanceID, action)
+	})
+	return op, nil
+}
+
+func (o *Orchestrator) manageInstance(ctx context.Context, instanceID string, action agenttypes.InstanceAction) error {
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, err := activeState(instanceID)
+	if err != nil {
+		return err
+	}
 
+	// Статус мог измениться, пока операция ждала блокировку.
+	target, _ := agenttypes.ActionTarget(action)
+	if err := state.CheckTransition(target); err != nil {
+		return err
+	}
+
+	timeout := 10
 	switch action {
 	case agenttypes.ActionStop:
 		err = o.dockerCli.ContainerStop(ctx, state.ContainerID, container.StopOptions{Timeout: &timeout})
-		if err == nil {
-			newStatus = "paused"
-		}
 	case agenttypes.ActionStart:
-		err = o.dockerCli.ContainerStart(ctx, state.ContainerID, container.StartOptions{})
-		if err == nil {
-			newStatus = "running"
-		}
+		err = o.startContainer(ctx, &state)
 	case agenttypes.ActionRestart:
 		err = o.dockerCli.ContainerRestart(ctx, state.ContainerID, container.StopOptions{Timeout: &timeout})
 		if err == nil {
-			newStatus = "running"
+			err = o.isolateStarted(ctx, &state)
+		}
+		if err == nil {
+			o.recordPublishedPorts(ctx, &state)
 		}
 	default:
 		return fmt.Errorf("unknown action: %s", action)
 	}
 
 	if err != nil {
-		return fmt.Errorf("manage action %s failed: %w", action, err)
+		err = fmt.Errorf("manage action %s failed: %w", action, err)
+		if terr := state.Transition(agenttypes.StatusError, err.Error()); terr == nil {
+			storage.SaveState(&state)
+		}
+		return err
 	}
 
-	if newStatus != state.Status {
-		state.Status = newStatus
-		storage.SaveState(&state)
+	if err := state.Transition(target, string(action)); err != nil {
+		return err
+	}
+	// Ручной запуск начинает отсчет перезапусков заново.
+	if target == agenttypes.StatusRunning {
+		state.RestartCount = 0
 	}
+	return storage.SaveState(&state)
+}
 
-	return nil
+// runningContainer возвращает ID контейнера запущенного инстанса.
+func runningContainer(instanceID string) (string, error) {
+	state, err := activeState(instanceID)
+	if err != nil {
+		return "", err
+	}
+	if state.Status != agenttypes.StatusRunning {
+		return "", fmt.Errorf("%w: instance %s is %s, not running", agenttypes.ErrInvalidTransition, instanceID, state.Status)
+	}
+	return state.ContainerID, nil
 }
 
-func (o *Orchestrator) AddSSHKey(ctx context.Context, key string) error {
-	state := storage.GetState()
-	if state.Status != "running" {
-		return fmt.Errorf("instance is not running")
+func (o *Orchestrator) AddSSHKey(ctx context.Context, instanceID, key string) error {
+	containerID, err := runningContainer(instanceID)
+	if err != nil {
+		return err
 	}
-	return addSSHKey(ctx, o.dockerCli, state.ContainerID, key)
+	return addSSHKey(ctx, o.dockerCli, containerID, key)
 }
 
-func (o *Orchestrator) RemoveSSHKey(ctx context.Context, key string) error {
-	state := storage.GetState()
-	if state.Status != "running" {
-		return fmt.Errorf("instance is not running")
+func (o *Orchestrator) RemoveSSHKey(ctx context.Context, instanceID, key string) error {
+	containerID, err := runningContainer(instanceID)
+	if err != nil {
+		return err
 	}
-	return removeSSHKey(ctx, o.dockerCli, state.ContainerID, key)
+	return removeSSHKey(ctx, o.dockerCli, containerID, key)
 }
 
-func (o *Orchestrator) ListSSHKeys(ctx context.Context) ([]string, error) {
-	state := storage.GetState()
-	if state.Status != "running" {
-		return nil, fmt.Errorf("instance is not running")
+func (o *Orchestrator) ListSSHKeys(ctx context.Context, instanceID string) ([]string, error) {
+	containerID, err := runningContainer(instanceID)
+	if err != nil {
+		return nil, err
 	}
 
-	out, err := listSSHKeys(ctx, o.dockerCli, state.ContainerID)
+	out, err := listSSHKeys(ctx, o.dockerCli, containerID)
 	if err != nil {
 		return nil, err
 	}
@@ -199,10 +594,13 @@ func (o *Orchestrator) ListSSHKeys(ctx context.Context) ([]string, error) {
 	return keys, nil
 }
 
-func (o *Orchestrator) GetInstanceLogs(ctx context.Context) (string, error) {
-	state := storage.GetState()
+func (o *Orchestrator) GetInstanceLogs(ctx context.Context, instanceID string) (string, error) {
+	state, err := activeState(instanceID)
+	if err != nil {
+		return "", err
+	}
 	if state.ContainerID == "" {
-		return "", fmt.Errorf("no instance found")
+		return "", fmt.Errorf("instance %s has no container", instanceID)
 	}
 
 	options := container.LogsOptions{
@@ -222,22 +620,36 @@ func (o *Orchestrator) GetInstanceLogs(ctx context.Context) (string, error) {
 	return buf.String(), nil
 }
 
+// SyncState приводит хост в соответствие с сохраненным состоянием после рестарта агента:
+// разбирает прерванные создания и запускает полную сверку ресурсов.
 func (o *Orchestrator) SyncState(ctx context.Context) error {
-	currentState := storage.GetState()
-	if currentState.ContainerID == "" {
-		return nil
+	o.gpus.ReclaimOrphans(ctx)
+	for _, state := range storage.ListStates() {
+		switch state.Status {
+		case agenttypes.StatusPending:
+			// Создание, прерванное остановкой агента: доводим по журналу или откатываем.
+			o.recoverInterruptedCreate(ctx, state)
+		case agenttypes.StatusDeleting:
+			log.Printf("Recovery: finishing deletion of instance %s", state.InstanceID)
+			err := o.rollback(ctx, &state)
+			if err != nil {
+				log.Printf("Recovery: failed to delete instance %s: %v", state.InstanceID, err)
+			}
+			for _, op := range storage.InterruptedOperations(state.InstanceID, agenttypes.OperationDelete) {
+				finishRecoveredOperation(op.OperationID, err)
+			}
+		default:
+			if hasContainer(state.Status) {
+				o.restoreInstance(ctx, state)
+			}
+		}
 	}
 
-	_, err := o.dockerCli.ContainerInspect(ctx, currentState.ContainerID)
-	if err != nil {
-		if client.IsErrNotFound(err) {
-
-			log.Printf("SyncState: Container %s not found. Cleaning up.", currentState.ContainerID)
-			o.rollback(ctx, &currentState)
-			return nil
+	var errs []error
+	for _, drift := range o.Reconcile(ctx) {
+		if !drift.Repaired {
+			errs = append(errs, fmt.Errorf("%s %s: %s", drift.InstanceID, drift.Resource, drift.Detail))
 		}
-		return fmt.Errorf("failed to inspect container: %w", err)
 	}
-
-	return nil
+	return errors.Join(errs...)
 }
@@ -0,0 +1,231 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// portMapping — элемент Ports: "порт[-порт][/протокол]" контейнера -> порт или диапазон хоста той же длины.
+type portMapping struct {
+	spec           string // ключ из Ports
+	proto          string
+	containerFirst int
+	containerLast  int
+	hostFirst      int // 0 — порт хоста выбирает Docker
+}
+
+func parsePortMapping(containerSpec, hostSpec string) (portMapping, error) {
+	proto, rawPort := nat.SplitProtoPort(containerSpec)
+	m := portMapping{spec: containerSpec, proto: strings.ToLower(proto)}
+	if m.proto != "tcp" && m.proto != "udp" {
+		return m, fmt.Errorf("port %s: unsupported protocol %q", containerSpec, proto)
+	}
+
+	var err error
+	if m.containerFirst, m.containerLast, err = parsePortRange(rawPort); err != nil {
+		return m, fmt.Errorf("port %s: %w", containerSpec, err)
+	}
+	if hostSpec == "" {
+		return m, nil
+	}
+	hostFirst, hostLast, err := parsePortRange(hostSpec)
+	if err != nil {
+		return m, fmt.Errorf("port %s: host port: %w", containerSpec, err)
+	}
+	if hostLast-hostFirst != m.containerLast-m.containerFirst {
+		return m, fmt.Errorf("port %s: host range %s does not match container range size", containerSpec, hostSpec)
+	}
+	m.hostFirst = hostFirst
+	return m, nil
+}
+
+func parsePortRange(raw string) (int, int, error) {
+	first, last, err := nat.ParsePortRangeToInt(raw)
+	if err != nil || raw == "" {
+		return 0, 0, fmt.Errorf("invalid port range %q", raw)
+	}
+	if first < 1 {
+		return 0, 0, fmt.Errorf("invalid port %d", first)
+	}
+	return first, last, nil
+}
+
+// parsePorts разбирает Ports запроса и проверяет, что порты контейнера и хоста не пересекаются.
+func parsePorts(ports map[string]string) ([]portMapping, error) {
+	specs := make([]string, 0, len(ports))
+	for spec := range ports {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+
+	mappings := make([]portMapping, 0, len(specs))
+	containerPorts := make(map[string]string)
+	hostPorts := make(map[string]string)
+	for _, spec := range specs {
+		m, err := parsePortMapping(spec, ports[spec])
+		if err != nil {
+			return nil, err
+		}
+		for offset := 0; offset <= m.containerLast-m.containerFirst; offset++ {
+			port := fmt.Sprintf("%d/%s", m.containerFirst+offset, m.proto)
+			if other, ok := containerPorts[port]; ok {
+				return nil, fmt.Errorf("container port %s is published by both %s and %s", port, other, spec)
+			}
+			containerPorts[port] = spec
+			if m.hostFirst == 0 {
+				continue
+			}
+			hostPort := fmt.Sprintf("%d/%s", m.hostFirst+offset, m.proto)
+			if other, ok := hostPorts[hostPort]; ok {
+				return nil, fmt.Errorf("host port %s is used by both %s and %s", hostPort, other, spec)
+			}
+			hostPorts[hostPort] = spec
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// resolvePorts раскрывает диапазоны в отображение "порт/протокол" контейнера -> порт хоста.
+// Пустой порт хоста означает, что его выбирает Docker.
+func resolvePorts(mappings []portMapping) map[string]string {
+	resolved := make(map[string]string)
+	for _, m := range mappings {
+		for offset := 0; offset <= m.containerLast-m.containerFirst; offset++ {
+			hostPort := ""
+			if m.hostFirst != 0 {
+				hostPort = strconv.Itoa(m.hostFirst + offset)
+			}
+			resolved[fmt.Sprintf("%d/%s", m.containerFirst+offset, m.proto)] = hostPort
+		}
+	}
+	return resolved
+}
+
+// publishPorts публикует каждый порт диапазонов отдельно, как это делает docker run -p.
+func publishPorts(mappings []portMapping, access map[string]agenttypes.PortAccess) (nat.PortSet, nat.PortMap, error) {
+	exposed := nat.PortSet{}
+	bindings := nat.PortMap{}
+	for _, m := range mappings {
+		for offset := 0; offset <= m.containerLast-m.containerFirst; offset++ {
+			port, err := nat.NewPort(m.proto, strconv.Itoa(m.containerFirst+offset))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid container port %s: %w", m.spec, err)
+			}
+			hostPort := ""
+			if m.hostFirst != 0 {
+				hostPort = strconv.Itoa(m.hostFirst + offset)
+			}
+			exposed[port] = struct{}{}
+			bindings[port] = []nat.PortBinding{{HostIP: portHostIP(access, m.spec), HostPort: hostPort}}
+		}
+	}
+	return exposed, bindings, nil
+}
+
+// recordPublishedPorts переписывает AllocatedPorts фактическими портами хоста из Docker:
+// порты, которые выбирает Docker, известны только после старта контейнера.
+func (o *Orchestrator) recordPublishedPorts(ctx context.Context, state *agenttypes.InstanceState) {
+	inspect, err := o.dockerCli.ContainerInspect(ctx, state.ContainerID)
+	if err != nil {
+		log.Printf("Warning: failed to read published ports of instance %s: %v", state.InstanceID, err)
+		return
+	}
+	published := make(map[string]string)
+	for port, bindings := range inspect.NetworkSettings.Ports {
+		// Порт на 0.0.0.0 Docker публикует и для IPv6, номер порта хоста у привязок один.
+		if len(bindings) > 0 {
+			published[string(port)] = bindings[0].HostPort
+		}
+	}
+	if len(published) > 0 {
+		state.AllocatedPorts = published
+	}
+}
+
+// resolvePortAccess проверяет ограничения доступа к портам из запроса и приводит источники к CIDR.
+func resolvePortAccess(req *agenttypes.CreateInstanceRequest) (map[string]agenttypes.PortAccess, error) {
+	if len(req.PortAccess) == 0 {
+		return nil, nil
+	}
+	addrs, err := hostAddresses()
+	if err != nil {
+		return nil, err
+	}
+
+	access := make(map[string]agenttypes.PortAccess, len(req.PortAccess))
+	for containerPort, portAccess := range req.PortAccess {
+		if _, ok := req.Ports[containerPort]; !ok {
+			return nil, fmt.Errorf("port_access: port %s is not published in ports", containerPort)
+		}
+		sources, err := parsePrefixes(portAccess.AllowedSources)
+		if err != nil {
+			return nil, fmt.Errorf("port_access %s: allowed_sources: %w", containerPort, err)
+		}
+		resolved := agenttypes.PortAccess{AllowedSources: formatPrefixes(sources)}
+
+		if portAccess.HostIP != "" {
+			ip, err := netip.ParseAddr(portAccess.HostIP)
+			if err != nil {
+				return nil, fmt.Errorf("port_access %s: invalid host_ip %q", containerPort, portAccess.HostIP)
+			}
+			if !ip.IsUnspecified() && !slices.Contains(addrs, ip.Unmap()) {
+				return nil, fmt.Errorf("port_access %s: host_ip %s is not an address of this host", containerPort, ip)
+			}
+			resolved.HostIP = ip.String()
+		}
+		access[containerPort] = resolved
+	}
+	return access, nil
+}
+
+// portHostIP возвращает адрес хоста, на котором публикуется порт контейнера.
+func portHostIP(access map[string]agenttypes.PortAccess, containerPort string) string {
+	if hostIP := access[containerPort].HostIP; hostIP != "" {
+		return hostIP
+	}
+	return "0.0.0.0"
+}
+
+// compileInbound раскладывает ограничения доступа к портам в правила: сначала разрешенные
+// источники, затем запрет всех остальных. Порты без ограничений открыты всем.
+func compileInbound(access map[string]agenttypes.PortAccess) []firewallRule {
+	ports := make([]string, 0, len(access))
+	for containerPort := range access {
+		ports = append(ports, containerPort)
+	}
+	sort.Strings(ports)
+
+	var compiled []firewallRule
+	for _, containerPort := range ports {
+		sources := access[containerPort].AllowedSources
+		// Ключи записаны агентом после проверки, поэтому ошибок разбора здесь нет.
+		m, err := parsePortMapping(containerPort, "")
+		if err != nil || len(sources) == 0 {
+			continue
+		}
+		rule := firewallRule{inbound: true, proto: m.proto, port: m.containerFirst}
+		if m.containerLast > m.containerFirst {
+			rule.portEnd = m.containerLast
+		}
+		for _, source := range sources {
+			if prefix, err := netip.ParsePrefix(source); err == nil {
+				allow := rule
+				allow.peer, allow.accept = prefix, true
+				compiled = append(compiled, allow)
+			}
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled
+}
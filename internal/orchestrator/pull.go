@@ -0,0 +1,249 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// pullReportInterval — как часто прогресс скачивания отправляется на бэкенд и в запись операции.
+const pullReportInterval = 5 * time.Second
+
+// pullTracker собирает прогресс скачивания образа по слоям и раздает его подписчикам.
+type pullTracker struct {
+	mu          sync.Mutex
+	progress    agenttypes.PullProgress
+	layers      map[string]*agenttypes.LayerProgress
+	order       []string
+	subscribers map[chan agenttypes.PullProgress]struct{}
+}
+
+func newPullTracker(instanceID, image string) *pullTracker {
+	return &pullTracker{
+		progress:    agenttypes.PullProgress{InstanceID: instanceID, Image: image, UpdatedAt: time.Now().UTC()},
+		layers:      make(map[string]*agenttypes.LayerProgress),
+		subscribers: make(map[chan agenttypes.PullProgress]struct{}),
+	}
+}
+
+// update применяет одно сообщение из потока ImagePull.
+func (p *pullTracker) update(msg *jsonmessage.JSONMessage) {
+	if msg.ID == "" {
+		return
+	}
+
+	p.mu.Lock()
+	layer, ok := p.layers[msg.ID]
+	if !ok {
+		layer = &agenttypes.LayerProgress{ID: msg.ID}
+		p.layers[msg.ID] = layer
+		p.order = append(p.order, msg.ID)
+	}
+	layer.Status = msg.Status
+
+	switch msg.Status {
+	case "Downloading":
+		if msg.Progress != nil {
+			layer.Current = msg.Progress.Current
+			if msg.Progress.Total > 0 {
+				layer.Total = msg.Progress.Total
+			}
+		}
+	case "Download complete", "Extracting", "Pull complete", "Already exists":
+		// Дальше слой только распаковывается: скачанный объем равен полному.
+		layer.Current = layer.Total
+	}
+	p.recalculate()
+	p.mu.Unlock()
+
+	p.publish()
+}
+
+// recalculate пересчитывает сводные счетчики. Вызывается под p.mu.
+func (p *pullTracker) recalculate() {
+	p.progress.Layers = p.progress.Layers[:0]
+	p.progress.DownloadedBytes = 0
+	p.progress.TotalBytes = 0
+	for _, id := range p.order {
+		layer := p.layers[id]
+		p.progress.Layers = append(p.progress.Layers, *layer)
+		p.progress.DownloadedBytes += layer.Current
+		p.progress.TotalBytes += layer.Total
+	}
+	if p.progress.TotalBytes > 0 {
+		p.progress.Percent = float64(p.progress.DownloadedBytes) / float64(p.progress.TotalBytes) * 100
+	}
+	p.progress.UpdatedAt = time.Now().UTC()
+}
+
+func (p *pullTracker) finish(err error) {
+	p.mu.Lock()
+	p.progress.Done = true
+	if err != nil {
+		p.progress.Error = err.Error()
+	} else {
+		p.progress.Percent = 100
+	}
+	p.progress.UpdatedAt = time.Now().UTC()
+	p.mu.Unlock()
+
+	p.publish()
+
+	p.mu.Lock()
+	for ch := range p.subscribers {
+		close(ch)
+		delete(p.subscribers, ch)
+	}
+	p.mu.Unlock()
+}
+
+func (p *pullTracker) snapshot() agenttypes.PullProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snap := p.progress
+	snap.Layers = append([]agenttypes.LayerProgress(nil), p.progress.Layers...)
+	return snap
+}
+
+// publish рассылает снимок подписчикам. Медленные подписчики пропускают промежуточные
+// снимки: каждый следующий все равно содержит полный прогресс.
+func (p *pullTracker) publish() {
+	snap := p.snapshot()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ch := range p.subscribers {
+		select {
+		case ch <- snap:
+		default:
+		}
+	}
+}
+
+func (p *pullTracker) subscribe() (<-chan agenttypes.PullProgress, func()) {
+	ch := make(chan agenttypes.PullProgress, 16)
+	snap := p.snapshot()
+
+	p.mu.Lock()
+	if p.progress.Done {
+		p.mu.Unlock()
+		ch <- snap
+		close(ch)
+		return ch, func() {}
+	}
+	ch <- snap
+	p.subscribers[ch] = struct{}{}
+	p.mu.Unlock()
+
+	cancel := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subscribers[ch]; ok {
+			delete(p.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// encodeRegistryAuth готовит заголовок X-Registry-Auth для ImagePull.
+func encodeRegistryAuth(auth *agenttypes.RegistryAuth) (string, error) {
+	if auth == nil {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+		ServerAddress: auth.ServerAddress,
+	})
+}
+
+// pullImage скачивает образ, разбирая поток jsonmessage в прогресс по слоям.
+func pullImage(ctx context.Context, cli *client.Client, imageName, registryAuth string, tracker *pullTracker) error {
+	reader, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{RegistryAuth: registryAuth})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", imageName, err)
+	}
+	defer func() { _ = reader.Close() }()
+
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read pull progress for %s: %w", imageName, err)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("failed to pull image %s: %s", imageName, msg.Error.Message)
+		}
+		tracker.update(&msg)
+	}
+}
+
+// pullInstanceImage скачивает образ инстанса, периодически сообщая прогресс бэкенду и в операцию.
+func (o *Orchestrator) pullInstanceImage(ctx context.Context, t *operationTracker, instanceID, imageName string, auth *agenttypes.RegistryAuth) error {
+	registryAuth, err := encodeRegistryAuth(auth)
+	if err != nil {
+		return fmt.Errorf("failed to encode registry credentials: %w", err)
+	}
+
+	tracker := newPullTracker(instanceID, imageName)
+	o.pulls.Store(instanceID, tracker)
+
+	stop := make(chan struct{})
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		ticker := time.NewTicker(pullReportInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				snap := tracker.snapshot()
+				t.Progress(30+int(snap.Percent/2), fmt.Sprintf("pulling image %s", imageName))
+				o.reportPullProgress(snap)
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err = pullImage(ctx, o.dockerCli, imageName, registryAuth, tracker)
+	close(stop)
+	<-reported
+
+	tracker.finish(err)
+	o.reportPullProgress(tracker.snapshot())
+	return err
+}
+
+func (o *Orchestrator) reportPullProgress(progress agenttypes.PullProgress) {
+	if err := o.qudataCli.ReportPullProgress(progress.InstanceID, progress); err != nil {
+		log.Printf("Warning: failed to report pull progress for instance %s: %v", progress.InstanceID, err)
+	}
+}
+
+// SubscribePullProgress возвращает поток снимков прогресса скачивания образа инстанса.
+// Канал закрывается, когда скачивание завершено.
+func (o *Orchestrator) SubscribePullProgress(instanceID string) (<-chan agenttypes.PullProgress, func(), error) {
+	value, ok := o.pulls.Load(instanceID)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: no image pull for instance %s", agenttypes.ErrInstanceNotFound, instanceID)
+	}
+	ch, cancel := value.(*pullTracker).subscribe()
+	return ch, cancel, nil
+}
@@ -0,0 +1,329 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	"github.com/nociriysname/qudata-agent/internal/utils"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// Ресурсы, которые проверяет сверка.
+const (
+	resourceContainer = "container"
+	resourceMapper    = "luks_mapper"
+	resourceMount     = "mount"
+	resourceGPU       = "gpu"
+	resourceIsolation = "network_isolation"
+	resourceStray     = "stray_resource"
+)
+
+// incidentIsolationRemoved — инцидент безопасности: у работающего инстанса не оказалось правил изоляции.
+const incidentIsolationRemoved = "network_isolation_removed"
+
+// reconciler собирает расхождения одного прохода сверки.
+type reconciler struct {
+	mu     sync.Mutex
+	drifts []agenttypes.Drift
+}
+
+// report фиксирует расхождение. repair вызывается сразу; nil означает, что чинить нечем.
+func (r *reconciler) report(instanceID, resource, detail string, repair func() error) {
+	drift := agenttypes.Drift{InstanceID: instanceID, Resource: resource, Detail: detail, DetectedAt: time.Now().UTC()}
+	if repair != nil {
+		if err := repair(); err != nil {
+			drift.Error = err.Error()
+		} else {
+			drift.Repaired = true
+		}
+	}
+
+	if drift.Repaired {
+		log.Printf("[Reconcile] %s %s: %s (repaired)", instanceID, resource, detail)
+	} else {
+		log.Printf("[Reconcile] %s %s: %s (NOT repaired: %s)", instanceID, resource, detail, drift.Error)
+	}
+
+	r.mu.Lock()
+	r.drifts = append(r.drifts, drift)
+	r.mu.Unlock()
+}
+
+// RunReconciler периодически сверяет хост с ожидаемым состоянием до отмены ctx.
+func (o *Orchestrator) RunReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.Reconcile(ctx)
+		}
+	}
+}
+
+// Reconcile сравнивает ожидаемое состояние каждого инстанса с фактическим, чинит то, что можно,
+// и сообщает бэкенду обо всех найденных расхождениях.
+func (o *Orchestrator) Reconcile(ctx context.Context) []agenttypes.Drift {
+	r := &reconciler{}
+
+	for _, state := range storage.ListStates() {
+		// Инстанс, над которым сейчас идет операция, проверим на следующем проходе.
+		unlock, ok := o.tryLockInstance(state.InstanceID)
+		if !ok {
+			continue
+		}
+		// Сверяются только инстансы, у которых должен быть контейнер.
+		current, exists := storage.GetState(state.InstanceID)
+		if exists && hasContainer(current.Status) {
+			o.reconcileInstance(ctx, r, current)
+		}
+		unlock()
+	}
+	o.reconcileStrayResources(ctx, r)
+
+	if len(r.drifts) > 0 {
+		if err := o.qudataCli.ReportDrift(r.drifts); err != nil {
+			log.Printf("Warning: failed to report reconcile drift: %v", err)
+		}
+	}
+	return r.drifts
+}
+
+func (o *Orchestrator) reconcileInstance(ctx context.Context, r *reconciler, state agenttypes.InstanceState) {
+	id := state.InstanceID
+
+	inspect, err := o.dockerCli.ContainerInspect(ctx, state.ContainerID)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			// Том не уничтожается: данные арендатора остаются до явного удаления инстанса бэкендом.
+			r.report(id, resourceContainer, fmt.Sprintf("container %s not found, instance marked failed", state.ContainerID), func() error {
+				return o.failMissingContainer(ctx, &state)
+			})
+			return
+		}
+		r.report(id, resourceContainer, fmt.Sprintf("failed to inspect container: %v", err), nil)
+		return
+	}
+
+	// Open открывает и монтирует том, поэтому чинит и закрытый mapper, и снятое монтирование.
+	volume := o.volumeFor(&state)
+	openVolume := func() error { return volume.Open(ctx, &state) }
+	if volume.Encrypted() {
+		mapperPath := mapperDevice(&state)
+		if !pathExists(mapperPath) {
+			r.report(id, resourceMapper, fmt.Sprintf("%s is not open", mapperPath), openVolume)
+		}
+		if !isMounted(state.MountPoint) {
+			r.report(id, resourceMount, fmt.Sprintf("%s is not mounted", state.MountPoint), openVolume)
+		}
+	} else if !volume.IsOpen(&state) {
+		r.report(id, resourceMount, fmt.Sprintf("%s does not exist", state.MountPoint), openVolume)
+	}
+
+	for _, dev := range state.GPUDevices {
+		functions := append([]agenttypes.PCIFunction{{PciAddress: dev.PciAddress, OriginalDriver: dev.OriginalDriver}}, dev.Functions...)
+		for _, fn := range functions {
+			if driver := currentDriver(fn.PciAddress); driver != "vfio-pci" {
+				fn := fn
+				r.report(id, resourceGPU, fmt.Sprintf("%s is bound to %q instead of vfio-pci", fn.PciAddress, driver), func() error {
+					_, err := bindToVFIO(ctx, fn.PciAddress, fn.OriginalDriver)
+					return err
+				})
+			}
+		}
+	}
+
+	if state.Status == agenttypes.StatusRunning && !inspect.State.Running {
+		// Событие die было пропущено: фиксируем выход и отдаем решение политике перезапуска.
+		r.report(id, resourceContainer, fmt.Sprintf("container is %s, expected running", inspect.State.Status), func() error {
+			exit := &agenttypes.ContainerExit{ExitCode: inspect.State.ExitCode, OOMKilled: inspect.State.OOMKilled, At: time.Now().UTC()}
+			exit.StartedAt, _ = time.Parse(time.RFC3339Nano, inspect.State.StartedAt)
+			if finished, err := time.Parse(time.RFC3339Nano, inspect.State.FinishedAt); err == nil {
+				exit.At = finished
+			}
+			state.LastExit = exit
+			if err := state.Transition(agenttypes.StatusExited, "container found stopped by reconcile"); err != nil {
+				return err
+			}
+			o.applyRestartPolicy(&state)
+			return storage.SaveState(&state)
+		})
+		return
+	}
+
+	// Изоляцию проверяем у любого работающего контейнера: его могли запустить в обход агента.
+	if !inspect.State.Running {
+		return
+	}
+
+	if state.Egress.Version < egressPolicyVersion {
+		// Инстанс создан до появления политики исходящего трафика: это не инцидент, правила просто переприменяются.
+		r.report(id, resourceIsolation, "egress policy was never applied", func() error {
+			if err := o.isolateStarted(ctx, &state); err != nil {
+				return err
+			}
+			return storage.SaveState(&state)
+		})
+		return
+	}
+
+	addrs, err := getContainerAddrs(ctx, o.dockerCli, state.ContainerID)
+	if err != nil {
+		r.report(id, resourceIsolation, fmt.Sprintf("cannot verify isolation: %v", err), nil)
+		return
+	}
+	isolated := containerAddrs{IPv4: state.IsolatedIP, IPv6: state.IsolatedIPv6}
+	missing := o.firewall.Missing(ctx, id, addrs, instanceRules(&state))
+	if len(missing) > 0 || addrs != isolated {
+		rules := make([]string, 0, len(missing))
+		for _, rule := range missing {
+			rules = append(rules, rule.String())
+		}
+		detail := fmt.Sprintf("missing %s rules for %s: %s", o.firewall.Name(), addrs, strings.Join(rules, ", "))
+		switch {
+		case state.IsolatedIP == "":
+			detail = fmt.Sprintf("network isolation was never applied to %s", addrs)
+		case addrs != isolated:
+			detail = fmt.Sprintf("container address changed from %s to %s outside the agent", isolated, addrs)
+		}
+		// Примененные агентом правила сами не пропадают: их снял кто-то на хосте,
+		// и контейнер мог успеть выйти в приватные сети.
+		incident := state.IsolatedIP != ""
+		r.report(id, resourceIsolation, detail, func() error {
+			if err := o.isolateStarted(ctx, &state); err != nil {
+				return err
+			}
+			return storage.SaveState(&state)
+		})
+		if incident {
+			if err := o.qudataCli.ReportInstanceIncident(id, incidentIsolationRemoved, detail); err != nil {
+				log.Printf("Warning: failed to report isolation incident of instance %s: %v", id, err)
+			}
+		}
+	}
+}
+
+// reconcileStrayResources ищет mapper-устройства и образы томов, которые не принадлежат ни одному инстансу.
+func (o *Orchestrator) reconcileStrayResources(ctx context.Context, r *reconciler) {
+	ownedMappers := make(map[string]bool)
+	ownedImages := make(map[string]bool)
+	for _, state := range storage.ListStates() {
+		ownedMappers[state.LuksMapperName] = true
+		ownedImages[state.LuksDevicePath] = true
+	}
+	for _, volume := range storage.ListVolumes() {
+		ownedMappers[volume.MapperName] = true
+		ownedImages[volume.DevicePath] = true
+	}
+
+	mappers, _ := filepath.Glob("/dev/mapper/qudata-*")
+	for _, mapperPath := range mappers {
+		name := filepath.Base(mapperPath)
+		// Тонкие тома в группе "qudata" тоже попадают под шаблон; закрываем только dm-crypt.
+		if ownedMappers[name] || !isCryptMapper(mapperPath) {
+			continue
+		}
+		r.report("", resourceStray, fmt.Sprintf("mapper %s has no owning instance", name), func() error {
+			return utils.RunCommand(ctx, "", "cryptsetup", "luksClose", name)
+		})
+	}
+
+	images, _ := filepath.Glob(filepath.Join(storageDir, "*.img"))
+	for _, image := range images {
+		if ownedImages[image] {
+			continue
+		}
+		// Образ может содержать данные арендатора: удаляем только вручную.
+		r.report("", resourceStray, fmt.Sprintf("volume image %s has no owning instance", image), nil)
+	}
+}
+
+// failMissingContainer переводит инстанс без контейнера в failed: снимает правила изоляции,
+// возвращает GPU хосту и закрывает том, сохраняя его данные.
+func (o *Orchestrator) failMissingContainer(ctx context.Context, state *agenttypes.InstanceState) error {
+	containerID := state.ContainerID
+	err := o.firewall.Remove(ctx, state.InstanceID)
+	if err != nil {
+		err = fmt.Errorf("failed to remove network isolation: %w", err)
+	}
+	if closeErr := o.volumeFor(state).Close(ctx, state); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close volume: %w", closeErr))
+	}
+	o.gpus.Release(ctx, state.InstanceID)
+	state.ContainerID = ""
+	state.GPUDevices = nil
+	if transitionErr := state.Transition(agenttypes.StatusFailed, fmt.Sprintf("container %s disappeared", containerID)); transitionErr != nil {
+		return errors.Join(err, transitionErr)
+	}
+	if saveErr := storage.SaveState(state); saveErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to persist failed status: %w", saveErr))
+	}
+	return err
+}
+
+// hasContainer сообщает, держит ли инстанс в этом статусе контейнер, GPU и открытый том.
+// Запускать контейнер по этому признаку нельзя: crash_loop и error не перезапускаются сами.
+func hasContainer(status agenttypes.InstanceStatus) bool {
+	switch status {
+	case agenttypes.StatusRunning, agenttypes.StatusPaused, agenttypes.StatusExited,
+		agenttypes.StatusCrashLoop, agenttypes.StatusError:
+		return true
+	}
+	return false
+}
+
+// tryLockInstance берет блокировку инстанса, только если она свободна.
+func (o *Orchestrator) tryLockInstance(instanceID string) (func(), bool) {
+	m, _ := o.locks.LoadOrStore(instanceID, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, false
+	}
+	return mu.Unlock, true
+}
+
+// isCryptMapper проверяет по UUID устройства device-mapper, что это том dm-crypt.
+func isCryptMapper(mapperPath string) bool {
+	dev, err := filepath.EvalSymlinks(mapperPath)
+	if err != nil {
+		return false
+	}
+	uuid, err := os.ReadFile(filepath.Join("/sys/class/block", filepath.Base(dev), "dm", "uuid"))
+	return err == nil && strings.HasPrefix(string(uuid), "CRYPT-")
+}
+
+func pathExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// isMounted проверяет по /proc/self/mountinfo, смонтировано ли что-нибудь в path.
+func isMounted(path string) bool {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && fields[4] == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,80 @@
+package orchestrator
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+	"github.com/shirou/gopsutil/v3/mem"
+
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const (
+	// Аннотации Kata, задающие размер виртуальной машины песочницы.
+	kataVCPUsAnnotation  = "io.katacontainers.config.hypervisor.default_vcpus"
+	kataMemoryAnnotation = "io.katacontainers.config.hypervisor.default_memory"
+
+	// Базовый размер VM: ядро гостя и kata-agent. Лимиты контейнера Kata добавляет к нему
+	// горячим подключением, поэтому сами лимиты в аннотации не входят.
+	kataVCPUsOverhead    = 1
+	kataMemoryOverheadMB = 512
+)
+
+var supportedUlimits = map[string]bool{
+	"core": true, "cpu": true, "data": true, "fsize": true, "locks": true, "memlock": true,
+	"msgqueue": true, "nice": true, "nofile": true, "nproc": true, "rss": true, "rtprio": true,
+	"rttime": true, "sigpending": true, "stack": true,
+}
+
+// validateResources проверяет лимиты запроса против возможностей хоста.
+func validateResources(req *agenttypes.CreateInstanceRequest) error {
+	if req.CPUCount < 0 || req.MemoryMB < 0 || req.ShmSizeMB < 0 || req.PidsLimit < 0 {
+		return fmt.Errorf("resource limits must not be negative")
+	}
+	if req.CPUCount > float64(runtime.NumCPU()) {
+		return fmt.Errorf("cpu_count %.2f exceeds host CPUs (%d)", req.CPUCount, runtime.NumCPU())
+	}
+	if req.MemoryMB > 0 {
+		if vMem, err := mem.VirtualMemory(); err == nil && uint64(req.MemoryMB+kataMemoryOverheadMB)<<20 > vMem.Total {
+			return fmt.Errorf("memory_mb %d exceeds host memory (%d MB)", req.MemoryMB, vMem.Total>>20)
+		}
+		if req.ShmSizeMB > req.MemoryMB {
+			return fmt.Errorf("shm_size_mb %d exceeds memory_mb %d", req.ShmSizeMB, req.MemoryMB)
+		}
+	}
+	for _, ulimit := range req.Ulimits {
+		if !supportedUlimits[ulimit.Name] {
+			return fmt.Errorf("unsupported ulimit %q", ulimit.Name)
+		}
+		if ulimit.Soft > ulimit.Hard {
+			return fmt.Errorf("ulimit %s: soft limit %d exceeds hard limit %d", ulimit.Name, ulimit.Soft, ulimit.Hard)
+		}
+	}
+	return nil
+}
+
+// applyResources переносит лимиты запроса в HostConfig контейнера. Аннотации Kata задают только
+// базовый размер VM: лимиты контейнера добавляются к нему, и VM получает оплаченные CPU и память.
+func applyResources(req *agenttypes.CreateInstanceRequest, hostConfig *container.HostConfig) {
+	if req.CPUCount > 0 {
+		hostConfig.NanoCPUs = int64(req.CPUCount * 1e9)
+		hostConfig.Annotations[kataVCPUsAnnotation] = strconv.Itoa(kataVCPUsOverhead)
+	}
+	if req.MemoryMB > 0 {
+		hostConfig.Memory = req.MemoryMB << 20
+		hostConfig.Annotations[kataMemoryAnnotation] = strconv.Itoa(kataMemoryOverheadMB)
+	}
+	if req.ShmSizeMB > 0 {
+		hostConfig.ShmSize = req.ShmSizeMB << 20
+	}
+	if req.PidsLimit > 0 {
+		pidsLimit := req.PidsLimit
+		hostConfig.PidsLimit = &pidsLimit
+	}
+	for _, ulimit := range req.Ulimits {
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &units.Ulimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+	}
+}
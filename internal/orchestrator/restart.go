@@ -0,0 +1,129 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const (
+	restartBackoffBase = 5 * time.Second
+	restartBackoffMax  = 5 * time.Minute
+
+	// stableRunDuration — после стольких минут работы падение не считается частью crash loop.
+	stableRunDuration = 10 * time.Minute
+	// crashLoopThreshold — число быстрых падений подряд, после которого перезапуски прекращаются.
+	crashLoopThreshold = 5
+)
+
+func validateRestartPolicy(policy *agenttypes.RestartPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	switch policy.Mode {
+	case agenttypes.RestartNever, agenttypes.RestartAlways:
+		if policy.MaxRetries != 0 {
+			return fmt.Errorf("restart_policy.max_retries is only valid with mode %q", agenttypes.RestartOnFailure)
+		}
+	case agenttypes.RestartOnFailure:
+		if policy.MaxRetries < 0 {
+			return fmt.Errorf("restart_policy.max_retries must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown restart_policy.mode %q", policy.Mode)
+	}
+	return nil
+}
+
+// requestRestartPolicy возвращает политику запроса; без нее контейнер не перезапускается.
+func requestRestartPolicy(req *agenttypes.CreateInstanceRequest) agenttypes.RestartPolicy {
+	if req.RestartPolicy == nil {
+		return agenttypes.RestartPolicy{Mode: agenttypes.RestartNever}
+	}
+	return *req.RestartPolicy
+}
+
+// applyRestartPolicy решает судьбу завершившегося контейнера: планирует перезапуск с
+// экспоненциальной задержкой или переводит инстанс в crash_loop. Вызывается под блокировкой
+// инстанса, состояние сохраняет вызывающий.
+func (o *Orchestrator) applyRestartPolicy(state *agenttypes.InstanceState) {
+	exit := state.LastExit
+	if state.Status != agenttypes.StatusExited || exit == nil {
+		return
+	}
+
+	policy := state.RestartPolicy
+	switch policy.Mode {
+	case agenttypes.RestartAlways:
+	case agenttypes.RestartOnFailure:
+		if exit.ExitCode == 0 && !exit.OOMKilled {
+			return
+		}
+	default:
+		return
+	}
+
+	if !exit.StartedAt.IsZero() && exit.At.Sub(exit.StartedAt) >= stableRunDuration {
+		state.RestartCount = 0
+	}
+
+	// max_retries только ужесточает порог crash loop: срабатывает тот предел, что достигнут раньше.
+	limit, reason := crashLoopThreshold, fmt.Sprintf("container crashed %d times in a row", state.RestartCount+1)
+	if policy.Mode == agenttypes.RestartOnFailure && policy.MaxRetries > 0 && policy.MaxRetries < limit {
+		limit, reason = policy.MaxRetries, fmt.Sprintf("restart limit of %d reached", policy.MaxRetries)
+	}
+	if state.RestartCount >= limit {
+		state.Transition(agenttypes.StatusCrashLoop, reason)
+		log.Printf("[Restart] Instance %s is crash-looping: %s", state.InstanceID, reason)
+		o.reportLifecycleEvent(agenttypes.LifecycleEvent{
+			InstanceID:  state.InstanceID,
+			ContainerID: state.ContainerID,
+			Action:      string(agenttypes.StatusCrashLoop),
+			Status:      state.Status,
+			ExitCode:    &exit.ExitCode,
+			OOMKilled:   exit.OOMKilled,
+			At:          time.Now().UTC(),
+		})
+		return
+	}
+
+	delay := restartBackoff(state.RestartCount)
+	state.RestartCount++
+	log.Printf("[Restart] Instance %s: restart %d in %s (policy %s)", state.InstanceID, state.RestartCount, delay, policy.Mode)
+
+	instanceID, containerID := state.InstanceID, state.ContainerID
+	time.AfterFunc(delay, func() {
+		o.restartExited(context.Background(), instanceID, containerID)
+	})
+}
+
+func restartBackoff(attempt int) time.Duration {
+	delay := restartBackoffBase << attempt
+	if delay <= 0 || delay > restartBackoffMax {
+		return restartBackoffMax
+	}
+	return delay
+}
+
+// restartExited запускает контейнер, если за время задержки инстанс никто не тронул.
+func (o *Orchestrator) restartExited(ctx context.Context, instanceID, containerID string) {
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, ok := storage.GetState(instanceID)
+	if !ok || state.Status != agenttypes.StatusExited || state.ContainerID != containerID {
+		return
+	}
+
+	if err := o.startContainer(ctx, &state); err != nil {
+		log.Printf("[Restart] Instance %s: restart failed: %v", instanceID, err)
+		state.Transition(agenttypes.StatusError, fmt.Sprintf("restart failed: %v", err))
+	} else {
+		state.Transition(agenttypes.StatusRunning, fmt.Sprintf("restarted by %s policy (attempt %d)", state.RestartPolicy.Mode, state.RestartCount))
+	}
+	o.saveEventState(&state)
+}
@@ -9,7 +9,7 @@ import (
 	"github.com/docker/docker/client"
 )
 
-func setupSSHInContainer(cli *client.Client, qClient QudataClient, containerID string) {
+func setupSSHInContainer(cli *client.Client, qClient QudataClient, instanceID, containerID string) {
 	log.Printf("Starting SSH setup in container %s...", containerID[:12])
 	time.Sleep(5 * time.Second)
 
@@ -39,7 +39,7 @@ func setupSSHInContainer(cli *client.Client, qClient QudataClient, containerID s
 
 	log.Printf("SSH daemon started for container %s.", containerID[:12])
 
-	if err := qClient.NotifyInstanceReady(containerID); err != nil {
+	if err := qClient.NotifyInstanceReady(instanceID); err != nil {
 		log.Printf("ERROR: Failed to notify server about instance readiness: %v", err)
 	}
 }
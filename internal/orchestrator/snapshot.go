@@ -0,0 +1,195 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nociriysname/qudata-agent/internal/keystore"
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// snapshotVolume — поставщики томов, которые умеют снимать снапшот и создавать том из него.
+type snapshotVolume interface {
+	// Snapshot копирует образ тома в storage.SnapshotImagePath и заполняет SizeBytes.
+	Snapshot(ctx context.Context, state *agenttypes.InstanceState, snapshot *agenttypes.Snapshot) error
+	// Restore создает том инстанса из снапшота размером не меньше storageGB и монтирует его.
+	Restore(ctx context.Context, state *agenttypes.InstanceState, snapshot agenttypes.Snapshot, storageGB int) error
+}
+
+// CreateSnapshot снимает снапшот тома инстанса в фоне.
+func (o *Orchestrator) CreateSnapshot(ctx context.Context, instanceID string) (*agenttypes.Snapshot, *agenttypes.Operation, error) {
+	state, err := activeState(instanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := o.checkSnapshottable(&state); err != nil {
+		return nil, nil, err
+	}
+
+	snapshot := &agenttypes.Snapshot{
+		SnapshotID:       uuid.New().String(),
+		SourceInstanceID: instanceID,
+		TenantID:         state.TenantID,
+		VolumeProvider:   o.volumeFor(&state).Name(),
+	}
+	op := o.startOperation(agenttypes.OperationSnapshot, instanceID, func(ctx context.Context, t *operationTracker) error {
+		t.Progress(10, fmt.Sprintf("creating snapshot %s", snapshot.SnapshotID))
+		return o.createSnapshot(ctx, instanceID, *snapshot)
+	})
+	return snapshot, op, nil
+}
+
+func (o *Orchestrator) createSnapshot(ctx context.Context, instanceID string, snapshot agenttypes.Snapshot) error {
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, err := activeState(instanceID)
+	if err != nil {
+		return err
+	}
+	if err := o.checkSnapshottable(&state); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(storage.SnapshotDir(snapshot.SnapshotID), 0700); err != nil {
+		return fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+	if err := o.takeSnapshot(ctx, &state, &snapshot); err != nil {
+		if cerr := storage.ClearSnapshot(snapshot.SnapshotID); cerr != nil {
+			log.Printf("Warning: failed to clean up snapshot %s: %v", snapshot.SnapshotID, cerr)
+		}
+		return err
+	}
+	log.Printf("Snapshot %s of instance %s created (%d bytes)", snapshot.SnapshotID, instanceID, snapshot.SizeBytes)
+	return nil
+}
+
+func (o *Orchestrator) takeSnapshot(ctx context.Context, state *agenttypes.InstanceState, snapshot *agenttypes.Snapshot) error {
+	// Снапшот зашифрован тем же DEK, но ключ переобернут под ID снапшота, чтобы пережить удаление инстанса.
+	wrapped, err := storage.LoadWrappedKey(state.InstanceID)
+	if err != nil {
+		return fmt.Errorf("no wrapped DEK for instance %s: %w", state.InstanceID, err)
+	}
+	rewrapped, err := rewrapKey(o.keys, state.InstanceID, wrapped, snapshot.SnapshotID)
+	if err != nil {
+		return err
+	}
+	if err := storage.SaveSnapshotKey(snapshot.SnapshotID, rewrapped); err != nil {
+		return fmt.Errorf("failed to save snapshot key: %w", err)
+	}
+
+	if err := o.volumeFor(state).(snapshotVolume).Snapshot(ctx, state, snapshot); err != nil {
+		return err
+	}
+	snapshot.Filesystem = state.Filesystem
+	snapshot.CreatedAt = time.Now().UTC()
+	return storage.SaveSnapshot(snapshot)
+}
+
+func (o *Orchestrator) checkSnapshottable(state *agenttypes.InstanceState) error {
+	if !hasContainer(state.Status) {
+		return fmt.Errorf("%w: instance %s is %s, snapshot is not possible", agenttypes.ErrInvalidTransition, state.InstanceID, state.Status)
+	}
+	volume := o.volumeFor(state)
+	if _, ok := volume.(snapshotVolume); !ok {
+		return fmt.Errorf("%w: %s volumes do not support snapshots", agenttypes.ErrInvalidRequest, volume.Name())
+	}
+	return nil
+}
+
+func (o *Orchestrator) ListSnapshots() []agenttypes.Snapshot {
+	return storage.ListSnapshots()
+}
+
+func (o *Orchestrator) GetSnapshot(snapshotID string) (*agenttypes.Snapshot, error) {
+	snapshot, ok := storage.GetSnapshot(snapshotID)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", agenttypes.ErrSnapshotNotFound, snapshotID)
+	}
+	return &snapshot, nil
+}
+
+// DeleteSnapshot уничтожает снапшот: сначала обернутый DEK, затем заголовок LUKS образа.
+// Снапшот, из которого сейчас восстанавливается том, не удаляется.
+func (o *Orchestrator) DeleteSnapshot(snapshotID string) error {
+	o.snapshotMu.Lock()
+	defer o.snapshotMu.Unlock()
+
+	if _, ok := storage.GetSnapshot(snapshotID); !ok {
+		return fmt.Errorf("%w: %s", agenttypes.ErrSnapshotNotFound, snapshotID)
+	}
+	if uses := o.snapshots[snapshotID]; uses > 0 {
+		return fmt.Errorf("%w: snapshot %s is being restored by %d operation(s)", agenttypes.ErrInvalidTransition, snapshotID, uses)
+	}
+	if err := storage.ClearSnapshotKey(snapshotID); err != nil {
+		return fmt.Errorf("failed to remove snapshot key: %w", err)
+	}
+	if err := wipeHeader(storage.SnapshotImagePath(snapshotID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to wipe snapshot header: %w", err)
+	}
+	return storage.ClearSnapshot(snapshotID)
+}
+
+// useSnapshot отмечает снапшот как читаемый до вызова release, чтобы его не удалили посреди копирования.
+func (o *Orchestrator) useSnapshot(snapshotID string) (agenttypes.Snapshot, func(), error) {
+	o.snapshotMu.Lock()
+	defer o.snapshotMu.Unlock()
+
+	snapshot, ok := storage.GetSnapshot(snapshotID)
+	if !ok {
+		return snapshot, nil, fmt.Errorf("%w: %s was deleted", agenttypes.ErrSnapshotNotFound, snapshotID)
+	}
+	o.snapshots[snapshotID]++
+	return snapshot, func() {
+		o.snapshotMu.Lock()
+		defer o.snapshotMu.Unlock()
+		if o.snapshots[snapshotID]--; o.snapshots[snapshotID] == 0 {
+			delete(o.snapshots, snapshotID)
+		}
+	}, nil
+}
+
+// snapshotForCreate проверяет, что из снапшота можно создать том на этом хосте. Снапшот чужого
+// арендатора для запроса не существует.
+func (o *Orchestrator) snapshotForCreate(req *agenttypes.CreateInstanceRequest) (agenttypes.Snapshot, error) {
+	snapshot, ok := storage.GetSnapshot(req.SnapshotID)
+	if !ok || snapshot.TenantID != req.TenantID {
+		return snapshot, fmt.Errorf("%w: %s", agenttypes.ErrSnapshotNotFound, req.SnapshotID)
+	}
+	if snapshot.VolumeProvider != o.volume {
+		return snapshot, fmt.Errorf("%w: snapshot was taken from a %s volume, host creates %s volumes",
+			agenttypes.ErrInvalidRequest, snapshot.VolumeProvider, o.volume)
+	}
+	if req.Filesystem != nil {
+		return snapshot, fmt.Errorf("%w: filesystem options cannot be changed when restoring a snapshot", agenttypes.ErrInvalidRequest)
+	}
+
+	minGB := int((snapshot.SizeBytes + 1<<30 - 1) >> 30)
+	if req.StorageGB == 0 {
+		req.StorageGB = minGB
+	}
+	if req.StorageGB < minGB {
+		return snapshot, fmt.Errorf("%w: storage_gb %d is smaller than snapshot (%dG)", agenttypes.ErrInvalidRequest, req.StorageGB, minGB)
+	}
+	return snapshot, nil
+}
+
+// rewrapKey переносит DEK из обертки с одним ID в обертку с другим.
+func rewrapKey(keys *keystore.Keystore, fromID string, wrapped []byte, toID string) ([]byte, error) {
+	dek, err := keys.Unwrap(fromID, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	rewrapped, err := keys.Wrap(toID, dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap DEK: %w", err)
+	}
+	return rewrapped, nil
+}
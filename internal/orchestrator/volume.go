@@ -0,0 +1,162 @@
+package orchestrator
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/nociriysname/qudata-agent/internal/cfg"
+	"github.com/nociriysname/qudata-agent/internal/keystore"
+	"github.com/nociriysname/qudata-agent/internal/storage"
+	agenttypes "github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// Имена поставщиков томов в конфигурации хоста.
+const (
+	VolumeLoop      = "loop"
+	VolumeLVMThin   = "lvm-thin"
+	VolumeDirectory = "directory"
+)
+
+// VolumeProvider создает, открывает, увеличивает и уничтожает том, который монтируется
+// в контейнер инстанса как /data.
+type VolumeProvider interface {
+	Name() string
+	// Encrypted сообщает, шифруется ли том (LUKS2 с DEK из keystore).
+	Encrypted() bool
+	// Prepare записывает в состояние пути тома до его создания, чтобы откат после падения
+	// знал, что удалять.
+	Prepare(state *agenttypes.InstanceState)
+	Create(ctx context.Context, state *agenttypes.InstanceState, storageGB int) error
+	// Open открывает и монтирует существующий том (после перезагрузки хоста).
+	Open(ctx context.Context, state *agenttypes.InstanceState) error
+	IsOpen(state *agenttypes.InstanceState) bool
+	// Close размонтирует и закрывает том, не уничтожая данные.
+	Close(ctx context.Context, state *agenttypes.InstanceState) error
+	Resize(ctx context.Context, state *agenttypes.InstanceState, storageGB int) error
+	// Capacity возвращает размер хранилища поставщика и физически свободное в нем место.
+	Capacity(ctx context.Context) (total int64, free int64, err error)
+	// Allocated возвращает, сколько места том уже физически занимает в хранилище.
+	Allocated(ctx context.Context, state *agenttypes.InstanceState) int64
+	// Destroy уничтожает том. Для зашифрованных томов возвращает сертификат удаления.
+	Destroy(ctx context.Context, state *agenttypes.InstanceState) (*agenttypes.DeletionCertificate, error)
+}
+
+// newVolumeProviders создает поставщиков, доступных на хосте, и проверяет, что выбранный в конфиге есть среди них.
+func newVolumeProviders(conf cfg.StorageConfig, keys *keystore.Keystore) (map[string]VolumeProvider, string, error) {
+	providers := map[string]VolumeProvider{
+		VolumeLoop:      &loopVolume{keys: keys},
+		VolumeDirectory: &dirVolume{},
+	}
+	if conf.VolumeGroup != "" && conf.ThinPool != "" {
+		providers[VolumeLVMThin] = &lvmThinVolume{keys: keys, volumeGroup: conf.VolumeGroup, thinPool: conf.ThinPool}
+	}
+
+	name := conf.Provider
+	if name == "" {
+		name = VolumeLoop
+	}
+	if _, ok := providers[name]; !ok {
+		if name == VolumeLVMThin {
+			return nil, "", fmt.Errorf("storage: %s provider requires volume_group and thin_pool", name)
+		}
+		return nil, "", fmt.Errorf("storage: unknown volume provider %q", name)
+	}
+	return providers, name, nil
+}
+
+// volumeFor возвращает поставщика, которым создан том инстанса. Инстансы старых версий
+// агента созданы на loop-файлах.
+func (o *Orchestrator) volumeFor(state *agenttypes.InstanceState) VolumeProvider {
+	if provider, ok := o.volumes[state.VolumeProvider]; ok {
+		return provider
+	}
+	return o.volumes[VolumeLoop]
+}
+
+// ResizeVolume увеличивает зашифрованный том инстанса в фоне, не останавливая контейнер.
+func (o *Orchestrator) ResizeVolume(ctx context.Context, instanceID string, storageGB int) (*agenttypes.Operation, error) {
+	if storageGB <= 0 {
+		return nil, fmt.Errorf("%w: storage_gb must be positive", agenttypes.ErrInvalidRequest)
+	}
+	state, err := activeState(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResizable(&state); err != nil {
+		return nil, err
+	}
+	if storageGB <= state.StorageGB {
+		return nil, fmt.Errorf("%w: new size %dG must be larger than current %dG", agenttypes.ErrInvalidRequest, storageGB, state.StorageGB)
+	}
+	releaseStorage, err := o.reserveStorage(ctx, o.volumeFor(&state), int64(storageGB-state.StorageGB)<<30)
+	if err != nil {
+		return nil, err
+	}
+
+	op := o.startOperation(agenttypes.OperationResize, instanceID, func(ctx context.Context, t *operationTracker) error {
+		defer releaseStorage()
+		t.Progress(10, fmt.Sprintf("growing volume to %dG", storageGB))
+		return o.resizeVolume(ctx, instanceID, storageGB)
+	})
+	return op, nil
+}
+
+func (o *Orchestrator) resizeVolume(ctx context.Context, instanceID string, storageGB int) error {
+	unlock := o.lockInstance(instanceID)
+	defer unlock()
+
+	state, err := activeState(instanceID)
+	if err != nil {
+		return err
+	}
+	if err := checkResizable(&state); err != nil {
+		return err
+	}
+
+	if err := o.volumeFor(&state).Resize(ctx, &state, storageGB); err != nil {
+		return err
+	}
+	state.StorageGB = storageGB
+	return storage.SaveState(&state)
+}
+
+// checkResizable разрешает рост тома, только пока он открыт и смонтирован.
+func checkResizable(state *agenttypes.InstanceState) error {
+	if !hasContainer(state.Status) {
+		return fmt.Errorf("%w: instance %s is %s, volume cannot be resized", agenttypes.ErrInvalidTransition, state.InstanceID, state.Status)
+	}
+	return nil
+}
+
+// restoreInstance поднимает инстанс после рестарта агента. Закрытый том означает перезагрузку
+// хоста: том открывается заново, а контейнер, который должен работать, запускается, потому что
+// его остановил не арендатор.
+func (o *Orchestrator) restoreInstance(ctx context.Context, state agenttypes.InstanceState) {
+	if err := o.openAttachedVolumes(ctx, &state); err != nil {
+		log.Printf("Recovery: %v", err)
+		return
+	}
+
+	volume := o.volumeFor(&state)
+	if !volume.IsOpen(&state) {
+		log.Printf("Recovery: reopening volume of instance %s", state.InstanceID)
+		if err := volume.Open(ctx, &state); err != nil {
+			log.Printf("Recovery: failed to reopen volume of instance %s: %v", state.InstanceID, err)
+			return
+		}
+		if state.Status == agenttypes.StatusRunning {
+			if err := o.startContainer(ctx, &state); err != nil {
+				state.Transition(agenttypes.StatusError, fmt.Sprintf("failed to start after reboot: %v", err))
+			}
+			o.saveEventState(&state)
+			return
+		}
+	}
+
+	if state.Status == agenttypes.StatusExited {
+		// Запланированный перезапуск потерялся вместе с прошлым процессом агента.
+		o.applyRestartPolicy(&state)
+		o.saveEventState(&state)
+	}
+}
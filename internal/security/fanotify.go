@@ -57,7 +57,7 @@ func (m *FanotifyMonitor) Stop() {
 	close(m.stopChan)
 	unix.Close(m.fd)
 	<-m.stoppedChan
-	log.Printf("[Security] Fanotify monitor stopped.", m.watchPath)
+	log.Printf("[Security] Fanotify monitor for path '%s' stopped.", m.watchPath)
 }
 
 func (m *FanotifyMonitor) runLoop() {
@@ -11,7 +11,7 @@ import (
 const lockdownFilePath = "/var/lib/qudata/lockdown.lock"
 
 type LockdownDependencies interface {
-	DeleteInstance(ctx context.Context) error
+	DeleteAllInstances(ctx context.Context) error
 	ReportIncident(incidentType, reason string) error
 }
 
@@ -35,12 +35,12 @@ func InitiateLockdown(deps LockdownDependencies, reason string) {
 		log.Printf("ERROR: Failed to report incident to server: %v", err)
 	}
 
-	// 3. Немедленно уничтожаем текущий инстанс, если он существует.
-	log.Println("Force-deleting active instance...")
-	if err := deps.DeleteInstance(context.Background()); err != nil {
+	// 3. Немедленно уничтожаем все инстансы хоста.
+	log.Println("Force-deleting all instances...")
+	if err := deps.DeleteAllInstances(context.Background()); err != nil {
 		log.Printf("ERROR: Emergency instance deletion failed: %v", err)
 	} else {
-		log.Println("Instance destroyed.")
+		log.Println("Instances destroyed.")
 	}
 
 	// 4. Безопасно удаляем локальные секреты.
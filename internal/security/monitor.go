@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/nociriysname/qudata-agent/internal/storage"
+	"github.com/nociriysname/qudata-agent/pkg/types"
 )
 
 type incidentReporter interface {
@@ -20,11 +21,11 @@ type incidentReporter interface {
 }
 
 type instanceDeleter interface {
-	DeleteInstance(ctx context.Context) error
+	DeleteAllInstances(ctx context.Context) error
 }
 
 type SecurityMonitor struct {
-	fanotifyMon  *FanotifyMonitor
+	fanotifyMons map[string]*FanotifyMonitor
 	auditMon     *AuditMonitor
 	authzPlugin  *AuthzPlugin
 	mu           sync.Mutex
@@ -44,6 +45,7 @@ func NewSecurityMonitor(orch instanceDeleter, cli incidentReporter) (*SecurityMo
 	}
 
 	return &SecurityMonitor{
+		fanotifyMons: make(map[string]*FanotifyMonitor),
 		auditMon:     auditMon,
 		authzPlugin:  authzPlugin,
 		orchestrator: orch,
@@ -51,8 +53,8 @@ func NewSecurityMonitor(orch instanceDeleter, cli incidentReporter) (*SecurityMo
 	}, nil
 }
 
-func (sm *SecurityMonitor) DeleteInstance(ctx context.Context) error {
-	return sm.orchestrator.DeleteInstance(ctx)
+func (sm *SecurityMonitor) DeleteAllInstances(ctx context.Context) error {
+	return sm.orchestrator.DeleteAllInstances(ctx)
 }
 
 func (sm *SecurityMonitor) ReportIncident(incidentType, reason string) error {
@@ -77,45 +79,59 @@ func (sm *SecurityMonitor) Stop() {
 	sm.authzPlugin.Stop()
 	sm.auditMon.Stop()
 	sm.mu.Lock()
-	if sm.fanotifyMon != nil {
-		sm.fanotifyMon.Stop()
-		sm.fanotifyMon = nil
+	for instanceID, mon := range sm.fanotifyMons {
+		mon.Stop()
+		delete(sm.fanotifyMons, instanceID)
 	}
 	sm.mu.Unlock()
 }
 
 // reconcileFanotify - это главный цикл сверки для fanotify. Он смотрит на текущее состояние
-// и решает, нужно ли включить или выключить защиту.
+// всех инстансов и решает, для каких нужно включить или выключить защиту.
 func (sm *SecurityMonitor) reconcileFanotify() {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	state := storage.GetState()
+	running := make(map[string]bool)
+	for _, state := range storage.ListStates() {
+		if state.Status != types.StatusRunning {
+			continue
+		}
+		running[state.InstanceID] = true
 
-	// Сценарий 1: Инстанс работает, а защита fanotify - нет. Нужно включить.
-	if state.Status == "running" && sm.fanotifyMon == nil {
-		log.Println("[Security] Instance detected. Attempting to start fanotify protection...")
+		// Сценарий 1: Инстанс работает, а защита fanotify - нет. Нужно включить.
+		if _, ok := sm.fanotifyMons[state.InstanceID]; ok {
+			continue
+		}
+		// Том-каталог не имеет файла-образа, за которым можно следить.
+		if state.LuksDevicePath == "" {
+			continue
+		}
+		log.Printf("[Security] Instance %s detected. Attempting to start fanotify protection...", state.InstanceID)
 
 		qemuPID, err := findQemuPID(state.ContainerID)
 		if err != nil {
 			log.Printf("ERROR: Could not find QEMU PID for container %s: %v. Retrying...", state.ContainerID, err)
-			return
+			continue
 		}
 
 		mon, err := NewFanotifyMonitor(state.LuksDevicePath, qemuPID, sm)
 		if err != nil {
 			log.Printf("ERROR: Failed to create fanotify monitor: %v", err)
-			return
+			continue
 		}
 		mon.Start()
-		sm.fanotifyMon = mon
+		sm.fanotifyMons[state.InstanceID] = mon
 	}
 
 	// Сценарий 2: Инстанс не работает, а защита fanotify - все еще включена. Нужно выключить.
-	if state.Status != "running" && sm.fanotifyMon != nil {
-		log.Println("[Security] Instance is not running. Stopping fanotify protection...")
-		sm.fanotifyMon.Stop()
-		sm.fanotifyMon = nil
+	for instanceID, mon := range sm.fanotifyMons {
+		if running[instanceID] {
+			continue
+		}
+		log.Printf("[Security] Instance %s is not running. Stopping fanotify protection...", instanceID)
+		mon.Stop()
+		delete(sm.fanotifyMons, instanceID)
 	}
 }
 
@@ -147,8 +163,8 @@ type lockdownDepsImpl struct {
 	cli  incidentReporter
 }
 
-func (d *lockdownDepsImpl) DeleteInstance(ctx context.Context) error {
-	return d.orch.DeleteInstance(ctx)
+func (d *lockdownDepsImpl) DeleteAllInstances(ctx context.Context) error {
+	return d.orch.DeleteAllInstances(ctx)
 }
 
 func (d *lockdownDepsImpl) ReportIncident(incidentType, reason string) error {
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+// certificatesDir хранит сертификаты удаления дольше самих инстансов, чтобы их можно было переотправить.
+const certificatesDir = "/var/lib/qudata/certificates"
+
+func SaveDeletionCertificate(cert *types.DeletionCertificate) error {
+	if err := os.MkdirAll(certificatesDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cert, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(certificatesDir, cert.Subject()+".json"), data, 0600)
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+)
+
+const gpuAssignmentsFile = "/var/lib/qudata/gpu_assignments.json"
+
+// GPUAssignment фиксирует, за каким инстансом числится карта и к какому драйверу ее вернуть.
+type GPUAssignment struct {
+	InstanceID     string `json:"instance_id"`
+	OriginalDriver string `json:"original_driver"`
+}
+
+// LoadGPUAssignments читает назначения PCI адрес -> инстанс. Отсутствующий файл означает пустой пул.
+func LoadGPUAssignments() map[string]GPUAssignment {
+	assignments := make(map[string]GPUAssignment)
+	data, err := os.ReadFile(gpuAssignmentsFile)
+	if err != nil {
+		return assignments
+	}
+	_ = json.Unmarshal(data, &assignments)
+	return assignments
+}
+
+func SaveGPUAssignments(assignments map[string]GPUAssignment) error {
+	data, err := json.MarshalIndent(assignments, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(gpuAssignmentsFile, data, 0600)
+}
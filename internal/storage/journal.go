@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const journalFileName = "journal.json"
+
+const (
+	JournalStarted = "started"
+	JournalDone    = "done"
+)
+
+// JournalEntry — отметка о начале или завершении шага создания инстанса
+// вместе со снимком состояния на этот момент.
+type JournalEntry struct {
+	Step  string              `json:"step"`
+	Phase string              `json:"phase"`
+	At    time.Time           `json:"at"`
+	State types.InstanceState `json:"state"`
+}
+
+// Journal — журнал шагов создания инстанса. Переживает падение агента и
+// позволяет при старте довести создание до конца или полностью откатить его.
+type Journal struct {
+	InstanceID  string         `json:"instance_id"`
+	OperationID string         `json:"operation_id"`
+	Entries     []JournalEntry `json:"entries"`
+}
+
+// Done сообщает, был ли шаг завершен.
+func (j *Journal) Done(step string) bool {
+	for _, entry := range j.Entries {
+		if entry.Step == step && entry.Phase == JournalDone {
+			return true
+		}
+	}
+	return false
+}
+
+// LastState возвращает последний записанный снимок состояния.
+func (j *Journal) LastState() (types.InstanceState, bool) {
+	if len(j.Entries) == 0 {
+		return types.InstanceState{}, false
+	}
+	return j.Entries[len(j.Entries)-1].State, true
+}
+
+func journalPath(instanceID string) string {
+	return filepath.Join(InstanceDir(instanceID), journalFileName)
+}
+
+// AppendJournal дописывает запись и синхронно сбрасывает журнал на диск.
+func AppendJournal(journal *Journal, entry JournalEntry) error {
+	journal.Entries = append(journal.Entries, entry)
+
+	if err := os.MkdirAll(InstanceDir(journal.InstanceID), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := journalPath(journal.InstanceID)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadJournal читает журнал инстанса. Если журнала нет, возвращает nil.
+func LoadJournal(instanceID string) (*Journal, error) {
+	data, err := os.ReadFile(journalPath(instanceID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var journal Journal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, err
+	}
+	return &journal, nil
+}
+
+func ClearJournal(instanceID string) error {
+	err := os.Remove(journalPath(instanceID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const wrappedKeyFileName = "volume.key"
+
+// keyDir — каталог обернутого DEK: рядом с состоянием инстанса или с метаданными именованного тома.
+func keyDir(id string) string {
+	if IsVolumeID(id) {
+		return VolumeDir(id)
+	}
+	return InstanceDir(id)
+}
+
+// SaveWrappedKey сохраняет обернутый DEK тома инстанса или именованного тома.
+func SaveWrappedKey(id string, data []byte) error {
+	dir := keyDir(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, wrappedKeyFileName), data, 0600)
+}
+
+func LoadWrappedKey(id string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(keyDir(id), wrappedKeyFileName))
+}
+
+// ClearWrappedKey удаляет обернутый DEK: без него том уже не расшифровать.
+func ClearWrappedKey(id string) error {
+	err := os.Remove(filepath.Join(keyDir(id), wrappedKeyFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const (
+	operationsDir = "/var/lib/qudata/operations"
+	// operationRetention — сколько хранить завершенные операции, чтобы бэкенд успел их забрать.
+	operationRetention = 7 * 24 * time.Hour
+)
+
+var (
+	operations = make(map[string]types.Operation)
+	opsMu      sync.RWMutex
+)
+
+// LoadOperations читает записи операций с диска. Операции, которые выполнялись в момент
+// остановки агента, помечаются как прерванные.
+func LoadOperations() error {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+
+	if err := os.MkdirAll(operationsDir, 0700); err != nil {
+		return fmt.Errorf("failed to create operations dir: %w", err)
+	}
+
+	entries, err := os.ReadDir(operationsDir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	operations = make(map[string]types.Operation)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(operationsDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var op types.Operation
+		if err := json.Unmarshal(data, &op); err != nil {
+			log.Printf("Warning: skipping corrupted operation file %s: %v", path, err)
+			continue
+		}
+
+		if op.Done() {
+			if op.FinishedAt != nil && now.Sub(*op.FinishedAt) > operationRetention {
+				_ = os.Remove(path)
+				continue
+			}
+		} else {
+			op.Phase = types.PhaseFailed
+			op.Error = InterruptedError
+			op.UpdatedAt = now
+			op.FinishedAt = &now
+			if err := writeOperationFile(&op); err != nil {
+				log.Printf("Warning: failed to mark operation %s as interrupted: %v", op.OperationID, err)
+			}
+		}
+		operations[op.OperationID] = op
+	}
+	return nil
+}
+
+// InterruptedError — ошибка операций, которые выполнялись при остановке агента.
+// Восстановление после рестарта может довести такую операцию до конца и переписать ее итог.
+const InterruptedError = "interrupted by agent restart"
+
+// InterruptedOperations возвращает прерванные рестартом операции инстанса заданного типа.
+func InterruptedOperations(instanceID string, opType types.OperationType) []types.Operation {
+	opsMu.RLock()
+	defer opsMu.RUnlock()
+
+	var interrupted []types.Operation
+	for _, op := range operations {
+		if op.InstanceID == instanceID && op.Type == opType && op.Phase == types.PhaseFailed && op.Error == InterruptedError {
+			interrupted = append(interrupted, op)
+		}
+	}
+	return interrupted
+}
+
+func GetOperation(operationID string) (types.Operation, bool) {
+	opsMu.RLock()
+	defer opsMu.RUnlock()
+	op, ok := operations[operationID]
+	return op, ok
+}
+
+func SaveOperation(op *types.Operation) error {
+	opsMu.Lock()
+	defer opsMu.Unlock()
+	operations[op.OperationID] = *op
+	return writeOperationFile(op)
+}
+
+func writeOperationFile(op *types.Operation) error {
+	if err := os.MkdirAll(operationsDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(op, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(operationsDir, op.OperationID+".json"), data, 0600)
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const (
+	snapshotsDir         = "/var/lib/qudata/snapshots"
+	snapshotMetaFileName = "snapshot.json"
+	snapshotImageName    = "volume.img"
+)
+
+// SnapshotDir возвращает каталог снапшота: образ, обернутый DEK и метаданные.
+func SnapshotDir(snapshotID string) string {
+	return filepath.Join(snapshotsDir, snapshotID)
+}
+
+func SnapshotImagePath(snapshotID string) string {
+	return filepath.Join(SnapshotDir(snapshotID), snapshotImageName)
+}
+
+// SaveSnapshot записывает метаданные. Снапшот без метаданных считается недописанным.
+func SaveSnapshot(snapshot *types.Snapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(SnapshotDir(snapshot.SnapshotID), snapshotMetaFileName), data, 0600)
+}
+
+func GetSnapshot(snapshotID string) (types.Snapshot, bool) {
+	var snapshot types.Snapshot
+	data, err := os.ReadFile(filepath.Join(SnapshotDir(snapshotID), snapshotMetaFileName))
+	if err != nil || json.Unmarshal(data, &snapshot) != nil {
+		return snapshot, false
+	}
+	return snapshot, true
+}
+
+// ListSnapshots возвращает завершенные снапшоты, от старых к новым.
+func ListSnapshots() []types.Snapshot {
+	entries, _ := os.ReadDir(snapshotsDir)
+	snapshots := []types.Snapshot{}
+	for _, entry := range entries {
+		if snapshot, ok := GetSnapshot(entry.Name()); ok {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt) })
+	return snapshots
+}
+
+func SaveSnapshotKey(snapshotID string, data []byte) error {
+	return writeFileAtomic(filepath.Join(SnapshotDir(snapshotID), wrappedKeyFileName), data, 0600)
+}
+
+func LoadSnapshotKey(snapshotID string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(SnapshotDir(snapshotID), wrappedKeyFileName))
+}
+
+// ClearSnapshotKey удаляет обернутый DEK снапшота: без него образ не расшифровать.
+func ClearSnapshotKey(snapshotID string) error {
+	err := os.Remove(filepath.Join(SnapshotDir(snapshotID), wrappedKeyFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func ClearSnapshot(snapshotID string) error {
+	return os.RemoveAll(SnapshotDir(snapshotID))
+}
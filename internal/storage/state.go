@@ -2,56 +2,154 @@ package storage
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/nociriysname/qudata-agent/pkg/types"
 )
 
-const stateFile = "/var/lib/qudata/state.json"
+const (
+	// legacyStateFile — файл единственного инстанса из старых версий агента.
+	legacyStateFile = "/var/lib/qudata/state.json"
+	instancesDir    = "/var/lib/qudata/instances"
+	stateFileName   = "state.json"
+)
 
 var (
-	currentState types.InstanceState
-	mu           sync.RWMutex
+	instances = make(map[string]types.InstanceState)
+	mu        sync.RWMutex
 )
 
-func init() {
-	currentState.Status = "destroyed"
+// InstanceDir возвращает каталог, в котором хранятся файлы инстанса.
+func InstanceDir(instanceID string) string {
+	return filepath.Join(instancesDir, instanceID)
 }
 
+// LoadState читает состояния всех инстансов с диска в реестр.
 func LoadState() error {
 	mu.Lock()
 	defer mu.Unlock()
 
-	data, err := os.ReadFile(stateFile)
+	if err := os.MkdirAll(instancesDir, 0700); err != nil {
+		return fmt.Errorf("failed to create instances dir: %w", err)
+	}
+	migrateLegacyState()
+
+	entries, err := os.ReadDir(instancesDir)
 	if err != nil {
-		if os.IsNotExist(err) {
-			currentState = types.InstanceState{Status: "destroyed"}
-			return nil
-		}
 		return err
 	}
-	return json.Unmarshal(data, &currentState)
+
+	instances = make(map[string]types.InstanceState)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(instancesDir, entry.Name(), stateFileName)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		var state types.InstanceState
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Printf("Warning: skipping corrupted state file %s: %v", path, err)
+			continue
+		}
+		instances[state.InstanceID] = state
+	}
+	return nil
+}
+
+// migrateLegacyState переносит state.json единственного инстанса в реестр.
+func migrateLegacyState() {
+	data, err := os.ReadFile(legacyStateFile)
+	if err != nil {
+		return
+	}
+
+	// Старый формат хранил одну карту в pci_address/original_driver.
+	var legacy struct {
+		types.InstanceState
+		PciAddress     string `json:"pci_address"`
+		OriginalDriver string `json:"original_driver"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil || legacy.InstanceID == "" {
+		_ = os.Remove(legacyStateFile)
+		return
+	}
+	state := legacy.InstanceState
+	if legacy.PciAddress != "" && len(state.GPUDevices) == 0 {
+		state.GPUDevices = []types.GPUDevice{{PciAddress: legacy.PciAddress, OriginalDriver: legacy.OriginalDriver}}
+	}
+
+	if err := writeStateFile(&state); err != nil {
+		log.Printf("Warning: failed to migrate legacy state: %v", err)
+		return
+	}
+	_ = os.Remove(legacyStateFile)
 }
 
-func GetState() types.InstanceState {
+// GetState возвращает состояние инстанса по его ID.
+func GetState(instanceID string) (types.InstanceState, bool) {
 	mu.RLock()
 	defer mu.RUnlock()
-	return currentState
+	state, ok := instances[instanceID]
+	return state, ok
+}
+
+// ListStates возвращает состояния всех известных инстансов, отсортированные по ID.
+func ListStates() []types.InstanceState {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	states := make([]types.InstanceState, 0, len(instances))
+	for _, state := range instances {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].InstanceID < states[j].InstanceID })
+	return states
 }
 
 func SaveState(state *types.InstanceState) error {
 	mu.Lock()
 	defer mu.Unlock()
-	currentState = *state
-
-	data, _ := json.MarshalIndent(state, "", "  ")
-	return os.WriteFile(stateFile, data, 0644)
+	instances[state.InstanceID] = *state
+	return writeStateFile(state)
 }
 
-func ClearState() error {
+func ClearState(instanceID string) error {
 	mu.Lock()
 	defer mu.Unlock()
-	currentState = types.InstanceState{Status: "destroyed"}
-	return os.Remove(stateFile)
+	delete(instances, instanceID)
+	return os.RemoveAll(InstanceDir(instanceID))
+}
+
+func writeStateFile(state *types.InstanceState) error {
+	dir := InstanceDir(state.InstanceID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, stateFileName), data, 0600)
+}
+
+// writeFileAtomic пишет файл через временный, чтобы при падении агента не остался обрезанный JSON.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
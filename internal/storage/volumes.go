@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nociriysname/qudata-agent/pkg/types"
+)
+
+const (
+	volumesDir         = "/var/lib/qudata/volumes"
+	volumeMetaFileName = "volume.json"
+	// VolumeIDPrefix отличает ID именованных томов от ID инстансов.
+	VolumeIDPrefix = "vol-"
+)
+
+// VolumeDir возвращает каталог именованного тома: метаданные и обернутый DEK.
+func VolumeDir(volumeID string) string {
+	return filepath.Join(volumesDir, volumeID)
+}
+
+func IsVolumeID(id string) bool {
+	return strings.HasPrefix(id, VolumeIDPrefix)
+}
+
+func SaveVolume(volume *types.PersistentVolume) error {
+	dir := VolumeDir(volume.VolumeID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(volume, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, volumeMetaFileName), data, 0600)
+}
+
+func GetVolume(volumeID string) (types.PersistentVolume, bool) {
+	var volume types.PersistentVolume
+	data, err := os.ReadFile(filepath.Join(VolumeDir(volumeID), volumeMetaFileName))
+	if err != nil || json.Unmarshal(data, &volume) != nil {
+		return volume, false
+	}
+	return volume, true
+}
+
+// ListVolumes возвращает именованные тома, от старых к новым.
+func ListVolumes() []types.PersistentVolume {
+	entries, _ := os.ReadDir(volumesDir)
+	volumes := []types.PersistentVolume{}
+	for _, entry := range entries {
+		if volume, ok := GetVolume(entry.Name()); ok {
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].CreatedAt.Before(volumes[j].CreatedAt) })
+	return volumes
+}
+
+func ClearVolume(volumeID string) error {
+	return os.RemoveAll(VolumeDir(volumeID))
+}
@@ -0,0 +1,92 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidTransition — действие недопустимо в текущем статусе инстанса.
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+type InstanceStatus string
+
+const (
+	StatusPending   InstanceStatus = "pending"    // создается
+	StatusRunning   InstanceStatus = "running"    // контейнер запущен
+	StatusPaused    InstanceStatus = "paused"     // контейнер остановлен по запросу
+	StatusExited    InstanceStatus = "exited"     // процесс контейнера завершился сам (выход, OOM, kill)
+	StatusCrashLoop InstanceStatus = "crash_loop" // контейнер постоянно падает, перезапуски остановлены
+	StatusDeleting  InstanceStatus = "deleting"   // ресурсы удаляются
+	StatusDestroyed InstanceStatus = "destroyed"  // все ресурсы удалены
+	StatusFailed    InstanceStatus = "failed"     // создание не удалось или контейнер пропал; ресурсы освобождены, кроме сохраненного тома
+	StatusError     InstanceStatus = "error"      // контейнер в неизвестном состоянии после сбоя действия
+)
+
+// transitions — разрешенные переходы. Переход running -> running означает рестарт.
+var transitions = map[InstanceStatus][]InstanceStatus{
+	StatusPending:   {StatusRunning, StatusFailed},
+	StatusRunning:   {StatusRunning, StatusPaused, StatusExited, StatusDeleting, StatusError, StatusFailed},
+	StatusPaused:    {StatusRunning, StatusDeleting, StatusError, StatusFailed},
+	StatusExited:    {StatusRunning, StatusPaused, StatusCrashLoop, StatusDeleting, StatusError, StatusFailed},
+	StatusCrashLoop: {StatusRunning, StatusPaused, StatusDeleting, StatusFailed},
+	StatusError:     {StatusRunning, StatusPaused, StatusDeleting, StatusFailed},
+	StatusFailed:    {StatusDeleting},
+	StatusDeleting:  {StatusDestroyed, StatusError},
+}
+
+// CanTransition сообщает, разрешен ли переход из from в to.
+func CanTransition(from, to InstanceStatus) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// ActionTarget возвращает статус, в который переводит инстанс действие управления.
+func ActionTarget(action InstanceAction) (InstanceStatus, bool) {
+	switch action {
+	case ActionStart, ActionRestart:
+		return StatusRunning, true
+	case ActionStop:
+		return StatusPaused, true
+	}
+	return "", false
+}
+
+// StatusTransition — запись истории статусов инстанса.
+type StatusTransition struct {
+	From   InstanceStatus `json:"from,omitempty"`
+	To     InstanceStatus `json:"to"`
+	At     time.Time      `json:"at"`
+	Reason string         `json:"reason,omitempty"`
+}
+
+// CheckTransition возвращает ErrInvalidTransition, если инстанс нельзя перевести в статус to.
+func (s *InstanceState) CheckTransition(to InstanceStatus) error {
+	if !CanTransition(s.Status, to) {
+		return fmt.Errorf("%w: instance %s is %s, cannot become %s", ErrInvalidTransition, s.InstanceID, s.Status, to)
+	}
+	return nil
+}
+
+// Transition переводит инстанс в статус to и дописывает переход в историю.
+func (s *InstanceState) Transition(to InstanceStatus, reason string) error {
+	if err := s.CheckTransition(to); err != nil {
+		return err
+	}
+	s.setStatus(to, reason)
+	return nil
+}
+
+// InitStatus задает начальный статус нового инстанса.
+func (s *InstanceState) InitStatus(status InstanceStatus) {
+	s.setStatus(status, "")
+}
+
+func (s *InstanceState) setStatus(to InstanceStatus, reason string) {
+	s.History = append(s.History, StatusTransition{From: s.Status, To: to, At: time.Now().UTC(), Reason: reason})
+	s.Status = to
+}
@@ -1,28 +1,192 @@
 package types
 
-import "github.com/nociriysname/qudata-agent/internal/attestation"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nociriysname/qudata-agent/internal/attestation"
+)
+
+var (
+	ErrInstanceNotFound  = errors.New("instance not found")
+	ErrOperationNotFound = errors.New("operation not found")
+	ErrInvalidRequest    = errors.New("invalid request")
+	ErrSnapshotNotFound  = errors.New("snapshot not found")
+	ErrVolumeNotFound    = errors.New("volume not found")
+	// ErrInsufficientStorage — на хосте не осталось места, которое можно пообещать новому тому.
+	ErrInsufficientStorage = errors.New("insufficient storage")
+)
 
 type InstanceState struct {
-	InstanceID     string            `json:"instance_id"`
-	ContainerID    string            `json:"container_id"`
-	Status         string            `json:"status"`
-	LuksDevicePath string            `json:"luks_device_path"`
-	LuksMapperName string            `json:"luks_mapper_name"`
-	MountPoint     string            `json:"mount_point"`
-	AllocatedPorts map[string]string `json:"allocated_ports"`
-	PciAddress     string            `json:"pci_address,omitempty"`
-	OriginalDriver string            `json:"original_driver,omitempty"`
+	InstanceID     string                `json:"instance_id"`
+	TenantID       string                `json:"tenant_id,omitempty"`
+	ContainerID    string                `json:"container_id"`
+	Image          string                `json:"image,omitempty"` // образ из запроса, по которому создается контейнер
+	Status         InstanceStatus        `json:"status"`
+	LuksDevicePath string                `json:"luks_device_path"`
+	LuksMapperName string                `json:"luks_mapper_name"`
+	MountPoint     string                `json:"mount_point"`
+	StorageGB      int                   `json:"storage_gb,omitempty"`
+	VolumeProvider string                `json:"volume_provider,omitempty"`
+	Filesystem     FilesystemOptions     `json:"filesystem"`
+	Volumes        []VolumeAttachment    `json:"volumes,omitempty"`
+	AllocatedPorts map[string]string     `json:"allocated_ports"`       // "порт/протокол" контейнера -> порт хоста
+	IsolatedIP     string                `json:"isolated_ip,omitempty"` // IP, для которого применены правила изоляции
+	IsolatedIPv6   string                `json:"isolated_ipv6,omitempty"`
+	Egress         EgressRules           `json:"egress"`
+	PortAccess     map[string]PortAccess `json:"port_access,omitempty"`
+	GPUDevices     []GPUDevice           `json:"gpu_devices,omitempty"`
+	SSHEnabled     bool                  `json:"ssh_enabled,omitempty"`
+	LastExit       *ContainerExit        `json:"last_exit,omitempty"`
+	RestartPolicy  RestartPolicy         `json:"restart_policy"`
+	RestartCount   int                   `json:"restart_count,omitempty"`
+	History        []StatusTransition    `json:"history,omitempty"`
+}
+
+// ContainerExit — как завершился контейнер инстанса в последний раз.
+type ContainerExit struct {
+	ExitCode  int       `json:"exit_code"`
+	OOMKilled bool      `json:"oom_killed"`
+	StartedAt time.Time `json:"started_at"`
+	At        time.Time `json:"at"`
+}
+
+// LifecycleEvent — событие жизненного цикла контейнера, которое агент пересылает бэкенду.
+type LifecycleEvent struct {
+	InstanceID  string         `json:"instance_id"`
+	ContainerID string         `json:"container_id"`
+	Action      string         `json:"action"`
+	Status      InstanceStatus `json:"status"`
+	ExitCode    *int           `json:"exit_code,omitempty"`
+	OOMKilled   bool           `json:"oom_killed,omitempty"`
+	Signal      string         `json:"signal,omitempty"`
+	At          time.Time      `json:"at"`
+}
+
+// GPUDevice описывает карту, проброшенную в инстанс через vfio-pci.
+type GPUDevice struct {
+	PciAddress     string `json:"pci_address"`
+	OriginalDriver string `json:"original_driver"`
+	IOMMUGroup     string `json:"iommu_group"`
+	// Functions — остальные функции той же группы IOMMU (HDMI-аудио, USB-C). VFIO отдает группу
+	// только целиком, поэтому они привязываются к vfio-pci вместе с картой.
+	Functions []PCIFunction `json:"functions,omitempty"`
+}
+
+// PCIFunction — функция PCI устройства и драйвер, к которому ее нужно вернуть.
+type PCIFunction struct {
+	PciAddress     string `json:"pci_address"`
+	OriginalDriver string `json:"original_driver,omitempty"`
 }
 
 type CreateInstanceRequest struct {
-	Image          string            `json:"image"`
-	ImageTag       string            `json:"image_tag"`
-	StorageGB      int               `json:"storage_gb"`
-	EnvVariables   map[string]string `json:"env_variables"`
-	Ports          map[string]string `json:"ports"`
-	SSHEnabled     bool              `json:"ssh_enabled"`
-	GPUCount       int               `json:"gpu_count"`
-	IsConfidential bool              `json:"is_confidential"`
+	Image          string                `json:"image"`
+	ImageTag       string                `json:"image_tag"`
+	StorageGB      int                   `json:"storage_gb"`
+	EnvVariables   map[string]string     `json:"env_variables"`
+	Ports          map[string]string     `json:"ports"` // "порт[-порт][/tcp|udp]" контейнера -> порт или диапазон хоста
+	SSHEnabled     bool                  `json:"ssh_enabled"`
+	GPUCount       int                   `json:"gpu_count"`
+	IsConfidential bool                  `json:"is_confidential"`
+	RegistryAuth   *RegistryAuth         `json:"registry_auth,omitempty"`
+	ImageSignature *ImageSignature       `json:"image_signature,omitempty"`
+	CPUCount       float64               `json:"cpu_count,omitempty"`
+	MemoryMB       int64                 `json:"memory_mb,omitempty"`
+	ShmSizeMB      int64                 `json:"shm_size_mb,omitempty"`
+	PidsLimit      int64                 `json:"pids_limit,omitempty"`
+	Ulimits        []Ulimit              `json:"ulimits,omitempty"`
+	RestartPolicy  *RestartPolicy        `json:"restart_policy,omitempty"`
+	Filesystem     *FilesystemOptions    `json:"filesystem,omitempty"`
+	SnapshotID     string                `json:"snapshot_id,omitempty"` // создать том из снапшота
+	TenantID       string                `json:"tenant_id,omitempty"`
+	Volumes        []VolumeAttachment    `json:"volumes,omitempty"`     // именованные тома арендатора
+	Egress         *EgressPolicy         `json:"egress,omitempty"`      // может только ужесточить политику хоста
+	PortAccess     map[string]PortAccess `json:"port_access,omitempty"` // ключ — порт контейнера из Ports
+}
+
+// FilesystemOptions — файловая система тома /data и параметры ее создания и монтирования.
+// Пустые поля берутся из конфигурации хоста.
+type FilesystemOptions struct {
+	Type                  string   `json:"type,omitempty"`                    // ext4 (по умолчанию) или xfs
+	ReservedBlocksPercent *float64 `json:"reserved_blocks_percent,omitempty"` // только ext4
+	BytesPerInode         int      `json:"bytes_per_inode,omitempty"`         // только ext4, меньше — больше inode
+	MountOptions          []string `json:"mount_options,omitempty"`
+}
+
+// EgressPolicy — куда контейнеру инстанса нельзя обращаться. AllowCIDRs — исключения из DenyCIDRs,
+// BlockedPorts закрыты для TCP и UDP на любых адресах.
+type EgressPolicy struct {
+	DenyCIDRs    []string `json:"deny_cidrs,omitempty"`
+	AllowCIDRs   []string `json:"allow_cidrs,omitempty"`
+	BlockedPorts []int    `json:"blocked_ports,omitempty"`
+}
+
+// EgressRules — итоговая политика инстанса. Правила применяются в порядке полей: закрытые порты,
+// запреты инстанса, разрешения, запреты хоста.
+type EgressRules struct {
+	// Version — версия политики, по которой собраны правила; 0 — инстанс создан до ее появления.
+	Version      int      `json:"version,omitempty"`
+	BlockedPorts []int    `json:"blocked_ports,omitempty"`
+	InstanceDeny []string `json:"instance_deny,omitempty"`
+	Allow        []string `json:"allow,omitempty"`
+	HostDeny     []string `json:"host_deny,omitempty"`
+}
+
+// PortAccess — доступ к опубликованному порту контейнера. Без AllowedSources порт открыт всем,
+// без HostIP публикуется на всех адресах хоста.
+type PortAccess struct {
+	AllowedSources []string `json:"allowed_sources,omitempty"`
+	HostIP         string   `json:"host_ip,omitempty"`
+}
+
+type RestartMode string
+
+const (
+	RestartNever     RestartMode = "never"
+	RestartOnFailure RestartMode = "on-failure"
+	RestartAlways    RestartMode = "always"
+)
+
+// RestartPolicy — политика перезапуска контейнера. Ее выполняет агент, а не Docker,
+// чтобы перезапуски шли с задержкой и останавливались при crash loop.
+type RestartPolicy struct {
+	Mode       RestartMode `json:"mode"`
+	MaxRetries int         `json:"max_retries,omitempty"` // только для on-failure; порог crash loop действует всегда, 0 — только он
+}
+
+// Ulimit — лимит ресурса процесса в контейнере (nofile, memlock, stack и т.д.).
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+// RegistryAuth — учетные данные приватного реестра. Они живут только в памяти на время
+// скачивания образа: при сериализации секреты отбрасываются, а String их не печатает.
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identity_token,omitempty"`
+	ServerAddress string `json:"server_address,omitempty"`
+}
+
+func (a *RegistryAuth) Validate() error {
+	if a.IdentityToken == "" && (a.Username == "" || a.Password == "") {
+		return errors.New("registry_auth requires username and password or identity_token")
+	}
+	return nil
+}
+
+func (a RegistryAuth) String() string {
+	return fmt.Sprintf("RegistryAuth{server: %q, username: %q, secrets: [REDACTED]}", a.ServerAddress, a.Username)
+}
+
+func (a RegistryAuth) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ServerAddress string `json:"server_address,omitempty"`
+	}{a.ServerAddress})
 }
 
 type InitAgentRequest struct {
@@ -54,6 +218,7 @@ type CreateHostRequest struct {
 	Location      Location                      `json:"location,omitempty"`
 	MaxCUDA       float64                       `json:"max_cuda"`
 	Configuration attestation.ConfigurationData `json:"configuration"`
+	Storage       *StorageCapacity              `json:"storage,omitempty"`
 }
 
 type InstanceAction string
@@ -68,12 +233,192 @@ type ManageInstanceRequest struct {
 	Action InstanceAction `json:"action"`
 }
 
+type ResizeVolumeRequest struct {
+	StorageGB int `json:"storage_gb"`
+}
+
 type StatsRequest struct {
-	GPUUtil float64 `json:"gpu_util"`
-	CPUUtil float64 `json:"cpu_util"`
-	RAMUtil float64 `json:"ram_util"`
-	MemUtil float64 `json:"mem_util"`
-	InetIn  int     `json:"inet_in"`
-	InetOut int     `json:"inet_out"`
-	Status  string  `json:"status"`
+	GPUUtil float64          `json:"gpu_util"`
+	CPUUtil float64          `json:"cpu_util"`
+	RAMUtil float64          `json:"ram_util"`
+	MemUtil float64          `json:"mem_util"`
+	InetIn  int              `json:"inet_in"`
+	InetOut int              `json:"inet_out"`
+	Status  string           `json:"status"`
+	Storage *StorageCapacity `json:"storage,omitempty"`
+}
+
+// StorageCapacity — емкость хранилища томов и то, сколько из нее обещано томам.
+// Тома разреженные, поэтому обещанное место занимается на диске постепенно.
+type StorageCapacity struct {
+	Provider       string `json:"provider"`
+	TotalBytes     int64  `json:"total_bytes"`
+	FreeBytes      int64  `json:"free_bytes"`      // физически свободно
+	ReservedBytes  int64  `json:"reserved_bytes"`  // сумма размеров томов
+	AllocatedBytes int64  `json:"allocated_bytes"` // часть резерва, уже записанная на диск
+	MarginBytes    int64  `json:"margin_bytes"`
+	AvailableBytes int64  `json:"available_bytes"` // можно отдать новым томам
+}
+
+type OperationType string
+
+const (
+	OperationCreate   OperationType = "create"
+	OperationDelete   OperationType = "delete"
+	OperationManage   OperationType = "manage"
+	OperationResize   OperationType = "resize"
+	OperationSnapshot OperationType = "snapshot"
+)
+
+type OperationPhase string
+
+const (
+	PhasePending   OperationPhase = "pending"
+	PhaseRunning   OperationPhase = "running"
+	PhaseSucceeded OperationPhase = "succeeded"
+	PhaseFailed    OperationPhase = "failed"
+)
+
+// Operation — фоновая операция над инстансом, которую бэкенд опрашивает по ID.
+type Operation struct {
+	OperationID string          `json:"operation_id"`
+	Type        OperationType   `json:"type"`
+	InstanceID  string          `json:"instance_id"`
+	Phase       OperationPhase  `json:"phase"`
+	Progress    int             `json:"progress"`
+	Message     string          `json:"message,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Rejection   *AdmissionError `json:"rejection,omitempty"` // отказ политики допуска образов
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+func (op *Operation) Done() bool {
+	return op.Phase == PhaseSucceeded || op.Phase == PhaseFailed
+}
+
+// LayerProgress — прогресс скачивания одного слоя образа.
+type LayerProgress struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Current int64  `json:"current"`
+	Total   int64  `json:"total"`
+}
+
+// PullProgress — сводный прогресс скачивания образа для инстанса.
+type PullProgress struct {
+	InstanceID      string          `json:"instance_id"`
+	Image           string          `json:"image"`
+	Layers          []LayerProgress `json:"layers"`
+	DownloadedBytes int64           `json:"downloaded_bytes"`
+	TotalBytes      int64           `json:"total_bytes"`
+	Percent         float64         `json:"percent"`
+	Done            bool            `json:"done"`
+	Error           string          `json:"error,omitempty"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+}
+
+// ImageSignature — отсоединенная подпись образа.
+// Payload (base64) — payload подписи в формате cosign; если он пуст, подписан сам дайджест манифеста.
+type ImageSignature struct {
+	Signature string `json:"signature"`
+	Payload   string `json:"payload,omitempty"`
+}
+
+// AdmissionError — отказ политики допуска образов. Отдается бэкенду в структурированном виде.
+type AdmissionError struct {
+	Code       string `json:"code"`
+	Reason     string `json:"reason"`
+	Image      string `json:"image"`
+	InstanceID string `json:"instance_id,omitempty"`
+}
+
+func (e *AdmissionError) Error() string {
+	return fmt.Sprintf("image %s rejected by admission policy (%s): %s", e.Image, e.Code, e.Reason)
+}
+
+// Drift — расхождение между ожидаемым и фактическим состоянием ресурса, найденное сверкой.
+type Drift struct {
+	InstanceID string    `json:"instance_id,omitempty"`
+	Resource   string    `json:"resource"`
+	Detail     string    `json:"detail"`
+	Repaired   bool      `json:"repaired"`
+	Error      string    `json:"error,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// DeletionCertificate — подписанный агентом отчет об уничтожении тома инстанса или именованного тома.
+// Подпись ed25519 ставится над JSON сертификата с пустым полем Signature.
+type DeletionCertificate struct {
+	InstanceID       string         `json:"instance_id,omitempty"`
+	VolumeID         string         `json:"volume_id,omitempty"` // для именованных томов
+	ImagePath        string         `json:"image_path"`
+	HeaderHashBefore string         `json:"header_hash_before,omitempty"`
+	HeaderHashAfter  string         `json:"header_hash_after,omitempty"`
+	StartedAt        time.Time      `json:"started_at"`
+	FinishedAt       time.Time      `json:"finished_at"`
+	Steps            []DeletionStep `json:"steps"`
+	Erased           bool           `json:"erased"`
+	PublicKey        []byte         `json:"public_key,omitempty"`
+	Signature        []byte         `json:"signature,omitempty"`
+}
+
+// Subject возвращает ID того, чей том уничтожен.
+func (c *DeletionCertificate) Subject() string {
+	if c.VolumeID != "" {
+		return c.VolumeID
+	}
+	return c.InstanceID
+}
+
+type DeletionStep struct {
+	Name    string    `json:"name"`
+	OK      bool      `json:"ok"`
+	Skipped bool      `json:"skipped,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Snapshot — копия зашифрованного тома инстанса. Образ остается зашифрованным исходным DEK,
+// который хранится обернутым KEK хоста рядом с метаданными.
+type Snapshot struct {
+	SnapshotID       string            `json:"snapshot_id"`
+	SourceInstanceID string            `json:"source_instance_id"`
+	TenantID         string            `json:"tenant_id,omitempty"` // арендатор инстанса; восстановить снапшот может только он
+	VolumeProvider   string            `json:"volume_provider"`
+	SizeBytes        int64             `json:"size_bytes"`
+	Filesystem       FilesystemOptions `json:"filesystem"`
+	CreatedAt        time.Time         `json:"created_at"`
+}
+
+// PersistentVolume — именованный зашифрованный том арендатора. Он создается отдельно
+// от инстансов, подключается к ним при создании или к остановленному инстансу и переживает их удаление.
+type PersistentVolume struct {
+	VolumeID       string            `json:"volume_id"`
+	Name           string            `json:"name"`
+	TenantID       string            `json:"tenant_id"`
+	SizeGB         int               `json:"size_gb"`
+	VolumeProvider string            `json:"volume_provider"`
+	Filesystem     FilesystemOptions `json:"filesystem"`
+	DevicePath     string            `json:"device_path,omitempty"`
+	MapperName     string            `json:"mapper_name,omitempty"`
+	MountPoint     string            `json:"mount_point"`
+	AttachedTo     string            `json:"attached_to,omitempty"` // ID инстанса
+	CreatedAt      time.Time         `json:"created_at"`
+}
+
+type CreateVolumeRequest struct {
+	Name       string             `json:"name"`
+	TenantID   string             `json:"tenant_id"`
+	SizeGB     int                `json:"size_gb"`
+	Filesystem *FilesystemOptions `json:"filesystem,omitempty"`
+}
+
+// VolumeAttachment — куда в контейнере монтируется именованный том.
+type VolumeAttachment struct {
+	VolumeID  string `json:"volume_id"`
+	MountPath string `json:"mount_path"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
 }